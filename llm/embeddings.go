@@ -0,0 +1,111 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/embeddings/bedrock"
+	"github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+// EmbedderFactory returns the embedder of modelId in provider, e.g. ollama
+// and nomic-embed-text.
+func EmbedderFactory(provider string, modelId string) (embeddings.Embedder, error) {
+	switch provider {
+	case "ollama":
+		client, err := ollama.New(ollama.WithModel(modelId))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Ollama embedder: %w", err)
+		}
+		return embeddings.NewEmbedder(client)
+	case "openai":
+		client, err := openai.New(openai.WithEmbeddingModel(modelId))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OpenAI embedder: %w", err)
+		}
+		return embeddings.NewEmbedder(client)
+	case "bedrock":
+		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		embedder, err := bedrock.NewBedrock(
+			bedrock.WithModel(modelId),
+			bedrock.WithClient(bedrockruntime.NewFromConfig(cfg)),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Bedrock embedder: %w", err)
+		}
+		return embedder, nil
+	default:
+		return nil, fmt.Errorf("provider %s not found", provider)
+	}
+}
+
+// MeteredEmbedder records the tokens embedded by another embedder in a usage
+// ledger. Embedding APIs do not report their usage through langchaingo, so the
+// tokens are estimated with CountTokens. Paid providers are not called once the
+// daily budget of the ledger is spent.
+type MeteredEmbedder struct {
+	embedder embeddings.Embedder
+	ledger   *UsageLedger
+	account  string
+	rule     string
+	provider string
+	model    string
+}
+
+// NewMeteredEmbedder records the usage of embedder, the modelId of provider,
+// in ledger under the given account and rule.
+func NewMeteredEmbedder(embedder embeddings.Embedder, ledger *UsageLedger, account string, rule string, provider string, modelId string) *MeteredEmbedder {
+	return &MeteredEmbedder{
+		embedder: embedder,
+		ledger:   ledger,
+		account:  account,
+		rule:     rule,
+		provider: provider,
+		model:    modelId,
+	}
+}
+
+// EmbedDocuments embeds texts, returning ErrBudgetExceeded instead if the
+// provider is paid and the budget is spent.
+func (e *MeteredEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	if IsPaidProvider(e.provider) && e.ledger.BudgetExceeded(time.Now()) {
+		return nil, ErrBudgetExceeded
+	}
+	vectors, err := e.embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	e.record(texts...)
+	return vectors, nil
+}
+
+// EmbedQuery embeds text, returning ErrBudgetExceeded instead if the provider
+// is paid and the budget is spent.
+func (e *MeteredEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	if IsPaidProvider(e.provider) && e.ledger.BudgetExceeded(time.Now()) {
+		return nil, ErrBudgetExceeded
+	}
+	vector, err := e.embedder.EmbedQuery(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	e.record(text)
+	return vector, nil
+}
+
+// record accounts the estimated tokens of texts as a single call.
+func (e *MeteredEmbedder) record(texts ...string) {
+	usage := Usage{}
+	for _, text := range texts {
+		usage.PromptTokens += CountTokens(e.provider, e.model, text)
+	}
+	e.ledger.Record(e.account, e.rule, e.model, usage)
+}
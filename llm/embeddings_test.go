@@ -0,0 +1,65 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeEmbedder returns a one-dimension vector per text and counts its calls.
+type fakeEmbedder struct {
+	calls *int
+}
+
+func (e fakeEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	*e.calls++
+	vectors := make([][]float32, len(texts))
+	for i := range texts {
+		vectors[i] = []float32{1}
+	}
+	return vectors, nil
+}
+
+func (e fakeEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	*e.calls++
+	return []float32{1}, nil
+}
+
+func TestMeteredEmbedder(t *testing.T) {
+	prices := map[string]Price{"text-embedding-3-small": {Prompt: 1000}}
+	ledger, err := NewUsageLedger(filepath.Join(t.TempDir(), "usage.json"), prices, 5)
+	if err != nil {
+		t.Fatalf("NewUsageLedger returned error: %v", err)
+	}
+	calls := 0
+	embedder := NewMeteredEmbedder(fakeEmbedder{calls: &calls}, ledger, "me@example.com", "train", "openai", "text-embedding-3-small")
+
+	if _, err := embedder.EmbedDocuments(context.Background(), []string{"abcd", "efgh"}); err != nil {
+		t.Fatalf("EmbedDocuments returned error: %v", err)
+	}
+	report := ledger.Report(time.Now())
+	if len(report) != 1 || report[0].Calls != 1 || report[0].PromptTokens != 2 || report[0].Rule != "train" {
+		t.Fatalf("Unexpected totals %+v", report)
+	}
+
+	// The texts cost $2, and so does each query: the budget of $5 is spent
+	// after the second one.
+	for i := 0; i < 2; i++ {
+		if _, err := embedder.EmbedQuery(context.Background(), "abcdefgh"); err != nil {
+			t.Fatalf("EmbedQuery returned error: %v", err)
+		}
+	}
+	if _, err := embedder.EmbedQuery(context.Background(), "abcdefgh"); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("Expected ErrBudgetExceeded, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected the provider not to be called over the budget, got %d calls", calls)
+	}
+
+	free := NewMeteredEmbedder(fakeEmbedder{calls: &calls}, ledger, "me@example.com", "train", "ollama", "nomic-embed-text")
+	if _, err := free.EmbedQuery(context.Background(), "abcd"); err != nil {
+		t.Errorf("Expected free providers to ignore the budget, got %v", err)
+	}
+}
@@ -86,7 +86,25 @@ func NewLLM(llmType LLMType, modelId string) (llms.Model, error) {
 	}
 }
 
+// PromptVersion identifies the classification prompt. Bump it whenever the
+// prompt changes so cached verdicts from the old prompt are not reused.
+const PromptVersion = "10"
+
+// Usage is the number of tokens consumed by a model call.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
 func ClassifyEmail(llm llms.Model, body string) (float64, string, error) {
+	score, reason, _, err := ClassifyEmailWithUsage(llm, body)
+	return score, reason, err
+}
+
+// ClassifyEmailWithUsage works like ClassifyEmail and also returns the token
+// usage reported by the provider in the response generation info, even when
+// the response cannot be parsed, as the call is billed anyway.
+func ClassifyEmailWithUsage(llm llms.Model, body string) (float64, string, Usage, error) {
 	responseSchema := []outputparser.ResponseSchema{
 		{Name: "SpamScore", Description: "Spam Score as Float between 0 and 10, less than 5 is considered not Spam, converted to string"},
 		{Name: "Reason", Description: "Brief 1 line sentence explaining the SPAM score assigned"},
@@ -99,6 +117,14 @@ func ClassifyEmail(llm llms.Model, body string) (float64, string, error) {
 Focus on the content and the intent of the email, and verify if they come from well-known domains and companies.
 Do not categorize as Spam emails from well-known organizations like github.com, meetup.com, etc. or well-known email providers like hotmail.com or gmail.com.
 Check for any links in the body and verify if they are legitimate.
+The LINKS section lists the links with their real destination after unwrapping redirectors, and flags links whose text shows a different domain (TEXT_MISMATCH), IP addresses (IP_LITERAL) and internationalized domains (PUNYCODE).
+The ATTACHMENTS section lists the attachments metadata (their content is not included), with flags for double extensions, executables, macro-enabled documents, encrypted archives and content not matching the declared type.
+The AUTHENTICATION lines are the SPF, DKIM and DMARC results recorded by our trusted mail servers; failures for a sender claiming to be a well-known domain are a strong sign of spoofing, and so is a WARNING about a whitelisted sender that is not authenticated.
+A SENDER WARNING means the sender domain imitates a well-known or trusted domain with lookalike characters, which is typical of phishing.
+Other header lines point out a Reply-To in another domain than the sender, the server that delivered the email to us, missing or foreign Message-IDs, bulk mailing markers, dates far from the reception time and the mailer software.
+The ORIGIN line is the host that handed the email to our servers, flagged when its name looks like a residential or dynamic address (RESIDENTIAL), it has no reverse DNS (NO_REVERSE_DNS) or it announced another name (HELO_MISMATCH); businesses and banks do not send from residential connections.
+DNSBL and URIBL lines mean the origin IP or a link domain is listed in a DNS blocklist of known spam sources.
+UPSTREAM FILTER lines are the verdicts of the spam filters run by our servers, with scores on the SpamAssassin scale (5 or more is spam, negative is clean) and the rules they triggered; weigh them as evidence, not as the final verdict.
 The HTML tags and images have been removed for simplicity.
 Only return the output as specified below.
 
@@ -124,32 +150,75 @@ Email Body:
 		llms.WithTemperature(0.1),
 	)
 	if err != nil {
-		return 0, "", err
+		return 0, "", Usage{}, err
 	}
 
 	choices := resp.Choices
 	if len(choices) < 1 {
-		return 0, "", fmt.Errorf("empty response from model")
+		return 0, "", Usage{}, fmt.Errorf("empty response from model")
 	}
+	usage := usageFromGenerationInfo(choices[0].GenerationInfo)
 
 	parsed, err := parser.Parse(choices[0].Content)
 	if err != nil {
-		return 0, "", fmt.Errorf("error parsing LLM result: %v", err)
+		return 0, "", usage, fmt.Errorf("error parsing LLM result: %v", err)
 	}
 
 	// Assert that parsedAny is a map[string]interface{}
 	resultMap, ok := parsed.(map[string]string)
 	if !ok {
-		return 0, "", fmt.Errorf("failed to assert parsed result as map[string]string")
+		return 0, "", usage, fmt.Errorf("failed to assert parsed result as map[string]string")
 	}
 
 	//fmt.Println(resultMap)
 	score, err := strconv.ParseFloat(resultMap["SpamScore"], 64)
 	if err != nil {
-		return 0, "", fmt.Errorf("error converting score to float: %v", err)
+		return 0, "", usage, fmt.Errorf("error converting score to float: %v", err)
 	}
 
 	reason := resultMap["Reason"]
-	return score, reason, nil
+	return score, reason, usage, nil
 
 }
+
+// usageFromGenerationInfo reads the token counts from the generation info.
+// OpenAI and Ollama use PromptTokens/CompletionTokens while the Bedrock
+// providers use input_tokens/output_tokens.
+func usageFromGenerationInfo(info map[string]any) Usage {
+	var usage Usage
+	for _, key := range []string{"PromptTokens", "input_tokens"} {
+		if n, ok := toInt(info[key]); ok {
+			usage.PromptTokens = n
+			break
+		}
+	}
+	for _, key := range []string{"CompletionTokens", "output_tokens"} {
+		if n, ok := toInt(info[key]); ok {
+			usage.CompletionTokens = n
+			break
+		}
+	}
+	return usage
+}
+
+func toInt(value any) (int, bool) {
+	switch n := value.(type) {
+	case int:
+		return n, true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case *int:
+		if n != nil {
+			return *n, true
+		}
+	case *int32:
+		if n != nil {
+			return int(*n), true
+		}
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
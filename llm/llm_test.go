@@ -39,3 +39,65 @@ func TestClassifySpam(t *testing.T) {
 	}
 
 }
+
+// usageLLM returns a fixed response with the given generation info.
+type usageLLM struct {
+	fakeLLM
+	info map[string]any
+}
+
+func (u usageLLM) GenerateContent(
+	ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: u.content, GenerationInfo: u.info}}}, nil
+}
+
+func TestClassifyEmailWithUsage(t *testing.T) {
+	content := "```json\n{\"SpamScore\": \"2\", \"Reason\": \"HAM\"}```"
+	tests := []struct {
+		name string
+		info map[string]any
+		want Usage
+	}{
+		{
+			name: "openai and ollama keys",
+			info: map[string]any{"PromptTokens": 120, "CompletionTokens": 15},
+			want: Usage{PromptTokens: 120, CompletionTokens: 15},
+		},
+		{
+			name: "bedrock keys",
+			info: map[string]any{"input_tokens": int32(80), "output_tokens": int32(9)},
+			want: Usage{PromptTokens: 80, CompletionTokens: 9},
+		},
+		{
+			name: "no generation info",
+			info: nil,
+			want: Usage{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockLLM := usageLLM{fakeLLM: fakeLLM{content: content}, info: tt.info}
+			score, _, usage, err := ClassifyEmailWithUsage(mockLLM, "Mock string")
+			if err != nil {
+				t.Fatalf("ClassifyEmailWithUsage returned error: %v", err)
+			}
+			if score != 2 {
+				t.Errorf("Expected score to be 2, got %f", score)
+			}
+			if usage != tt.want {
+				t.Errorf("Expected usage %+v, got %+v", tt.want, usage)
+			}
+		})
+	}
+}
+
+func TestClassifyEmailWithUsageOnParseError(t *testing.T) {
+	mockLLM := usageLLM{fakeLLM: fakeLLM{content: "not json"}, info: map[string]any{"PromptTokens": 120, "CompletionTokens": 15}}
+	_, _, usage, err := ClassifyEmailWithUsage(mockLLM, "Mock string")
+	if err == nil {
+		t.Fatalf("Expected a parsing error")
+	}
+	if usage != (Usage{PromptTokens: 120, CompletionTokens: 15}) {
+		t.Errorf("Expected the usage of the failed call, got %+v", usage)
+	}
+}
@@ -0,0 +1,56 @@
+package llm
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// charsPerToken is the average number of ASCII characters per token for each
+// provider's tokenizers. It is only an estimate, good enough for budgeting.
+var charsPerToken = map[string]float64{
+	"openai":  4.0,
+	"bedrock": 3.5,
+	"ollama":  3.5,
+}
+
+// modelCharsPerToken overrides the provider estimate for model families whose
+// tokenizers are known to be noticeably different. The first family found in
+// the model ID wins, so more specific names go first.
+var modelCharsPerToken = []struct {
+	family string
+	ratio  float64
+}{
+	{"gpt-4o", 4.4},
+	{"claude", 3.5},
+	{"gemma", 4.2},
+	{"llama3", 4.2},
+	{"mistral", 3.2},
+}
+
+// CountTokens estimates how many tokens text uses with the given provider and
+// model. ASCII text is counted by characters per token, while every non-ASCII
+// rune is counted as a token on its own, as most tokenizers split them.
+func CountTokens(provider string, modelId string, text string) int {
+	ratio, ok := charsPerToken[provider]
+	if !ok {
+		ratio = 3.5
+	}
+	for _, model := range modelCharsPerToken {
+		if strings.Contains(strings.ToLower(modelId), model.family) {
+			ratio = model.ratio
+			break
+		}
+	}
+
+	ascii := 0
+	other := 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return int(math.Ceil(float64(ascii)/ratio)) + other
+}
@@ -0,0 +1,28 @@
+package llm
+
+import "testing"
+
+func TestCountTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		model    string
+		text     string
+		want     int
+	}{
+		{name: "empty text", provider: "openai", model: "gpt-4", text: "", want: 0},
+		{name: "openai ascii", provider: "openai", model: "gpt-4", text: "abcdefgh", want: 2},
+		{name: "unknown provider", provider: "other", model: "x", text: "abcdefg", want: 2},
+		{name: "model override", provider: "ollama", model: "mistral:7b", text: "abcdefg", want: 3},
+		{name: "first family wins", provider: "ollama", model: "mistral-gemma:7b", text: "abcdefghijklm", want: 4},
+		{name: "non ascii runes", provider: "openai", model: "gpt-4", text: "abcd日本", want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CountTokens(tt.provider, tt.model, tt.text)
+			if got != tt.want {
+				t.Errorf("CountTokens() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Price is the cost in USD per 1000 tokens of a model.
+type Price struct {
+	Prompt     float64 `yaml:"prompt"`
+	Completion float64 `yaml:"completion"`
+}
+
+// usageRetentionDays is how many days of totals the ledger keeps.
+const usageRetentionDays = 31
+
+// ErrBudgetExceeded is returned instead of calling a paid provider once the
+// daily budget is spent.
+var ErrBudgetExceeded = errors.New("daily budget exceeded")
+
+// UsageTotals accumulates the usage of an account, rule and model in a day.
+type UsageTotals struct {
+	Account          string  `json:"account"`
+	Rule             string  `json:"rule"`
+	Model            string  `json:"model"`
+	Calls            int     `json:"calls"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// UsageLedger keeps the daily token usage and cost of the classifications,
+// persisted as JSON like the last processed files.
+type UsageLedger struct {
+	Days        map[string]map[string]*UsageTotals `json:"days"`
+	Filename    string                             `json:"-"`
+	Prices      map[string]Price                   `json:"-"`
+	DailyBudget float64                            `json:"-"`
+
+	mu sync.Mutex
+}
+
+// paidProviders are the providers billed per token.
+var paidProviders = map[string]bool{
+	"openai":  true,
+	"bedrock": true,
+}
+
+// IsPaidProvider returns true if the provider bills per token.
+func IsPaidProvider(provider string) bool {
+	return paidProviders[provider]
+}
+
+// NewUsageLedger loads the ledger stored in filename. A missing file is not an
+// error, the ledger simply starts empty.
+func NewUsageLedger(filename string, prices map[string]Price, dailyBudget float64) (*UsageLedger, error) {
+	ledger := &UsageLedger{
+		Days:        map[string]map[string]*UsageTotals{},
+		Filename:    filename,
+		Prices:      prices,
+		DailyBudget: dailyBudget,
+	}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return ledger, nil
+	}
+	if err != nil {
+		return ledger, err
+	}
+	if err := json.Unmarshal(data, ledger); err != nil {
+		return ledger, err
+	}
+	if ledger.Days == nil {
+		ledger.Days = map[string]map[string]*UsageTotals{}
+	}
+	return ledger, nil
+}
+
+func dayKey(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// Record adds the usage of a call to today's totals and returns its cost.
+func (l *UsageLedger) Record(account string, rule string, model string, usage Usage) float64 {
+	price := l.Prices[model]
+	cost := float64(usage.PromptTokens)/1000*price.Prompt + float64(usage.CompletionTokens)/1000*price.Completion
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	day := dayKey(time.Now())
+	if l.Days[day] == nil {
+		l.Days[day] = map[string]*UsageTotals{}
+	}
+	key := account + "|" + rule + "|" + model
+	totals, ok := l.Days[day][key]
+	if !ok {
+		totals = &UsageTotals{Account: account, Rule: rule, Model: model}
+		l.Days[day][key] = totals
+	}
+	totals.Calls++
+	totals.PromptTokens += usage.PromptTokens
+	totals.CompletionTokens += usage.CompletionTokens
+	totals.Cost += cost
+	return cost
+}
+
+// DailyCost returns the total cost spent on the day of t.
+func (l *UsageLedger) DailyCost(t time.Time) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cost := 0.0
+	for _, totals := range l.Days[dayKey(t)] {
+		cost += totals.Cost
+	}
+	return cost
+}
+
+// BudgetExceeded returns true if a daily budget is set and the cost spent on
+// the day of t reached it.
+func (l *UsageLedger) BudgetExceeded(t time.Time) bool {
+	return l.DailyBudget > 0 && l.DailyCost(t) >= l.DailyBudget
+}
+
+// Report returns the totals of the day of t sorted by account, rule and model.
+func (l *UsageLedger) Report(t time.Time) []UsageTotals {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var report []UsageTotals
+	for _, totals := range l.Days[dayKey(t)] {
+		report = append(report, *totals)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Account != report[j].Account {
+			return report[i].Account < report[j].Account
+		}
+		if report[i].Rule != report[j].Rule {
+			return report[i].Rule < report[j].Rule
+		}
+		return report[i].Model < report[j].Model
+	})
+	return report
+}
+
+// Save drops the days older than usageRetentionDays and writes the ledger to
+// disk.
+func (l *UsageLedger) Save() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	oldest := dayKey(time.Now().AddDate(0, 0, -usageRetentionDays))
+	for day := range l.Days {
+		if day < oldest {
+			delete(l.Days, day)
+		}
+	}
+
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(l.Filename, data, 0644)
+}
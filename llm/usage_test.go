@@ -0,0 +1,80 @@
+package llm
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageLedger(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "usage.json")
+	prices := map[string]Price{"gpt-4o-mini": {Prompt: 1, Completion: 2}}
+
+	ledger, err := NewUsageLedger(filename, prices, 5)
+	if err != nil {
+		t.Fatalf("NewUsageLedger returned error: %v", err)
+	}
+
+	cost := ledger.Record("me@example.com", "Spam?", "gpt-4o-mini", Usage{PromptTokens: 1000, CompletionTokens: 500})
+	if cost != 2 {
+		t.Errorf("Expected cost 2, got %f", cost)
+	}
+	ledger.Record("me@example.com", "Spam?", "gpt-4o-mini", Usage{PromptTokens: 2000, CompletionTokens: 0})
+	ledger.Record("me@example.com", "INBOX", "gemma3:1b", Usage{PromptTokens: 2000, CompletionTokens: 100})
+
+	now := time.Now()
+	if ledger.BudgetExceeded(now) {
+		t.Errorf("Expected budget not to be exceeded with cost %f", ledger.DailyCost(now))
+	}
+	ledger.Record("me@example.com", "Spam?", "gpt-4o-mini", Usage{PromptTokens: 1000})
+	if !ledger.BudgetExceeded(now) {
+		t.Errorf("Expected budget to be exceeded with cost %f", ledger.DailyCost(now))
+	}
+
+	if err := ledger.Save(); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	reloaded, err := NewUsageLedger(filename, prices, 0)
+	if err != nil {
+		t.Fatalf("NewUsageLedger returned error: %v", err)
+	}
+	report := reloaded.Report(now)
+	if len(report) != 2 {
+		t.Fatalf("Expected 2 report lines, got %d", len(report))
+	}
+	if report[0].Rule != "INBOX" || report[0].Cost != 0 {
+		t.Errorf("Unexpected unpriced totals %+v", report[0])
+	}
+	if report[1].Calls != 3 || report[1].PromptTokens != 4000 || math.Abs(report[1].Cost-5) > 1e-9 {
+		t.Errorf("Unexpected totals %+v", report[1])
+	}
+	if reloaded.BudgetExceeded(now) {
+		t.Errorf("Expected no budget to never be exceeded")
+	}
+}
+
+func TestUsageLedgerPrunesOldDays(t *testing.T) {
+	ledger, err := NewUsageLedger(filepath.Join(t.TempDir(), "usage.json"), nil, 0)
+	if err != nil {
+		t.Fatalf("NewUsageLedger returned error: %v", err)
+	}
+	old := dayKey(time.Now().AddDate(0, 0, -usageRetentionDays-1))
+	ledger.Days[old] = map[string]*UsageTotals{"a|b|c": {Calls: 1}}
+	ledger.Record("a", "b", "c", Usage{PromptTokens: 1})
+	if err := ledger.Save(); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if _, ok := ledger.Days[old]; ok {
+		t.Errorf("Expected day %s to be pruned", old)
+	}
+	if len(ledger.Days) != 1 {
+		t.Errorf("Expected today to be kept, got %v", ledger.Days)
+	}
+}
+
+func TestIsPaidProvider(t *testing.T) {
+	if !IsPaidProvider("openai") || !IsPaidProvider("bedrock") || IsPaidProvider("ollama") {
+		t.Errorf("Unexpected paid providers")
+	}
+}
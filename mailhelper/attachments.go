@@ -0,0 +1,181 @@
+package mailhelper
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	// AttachmentDoubleExtension flags names like invoice.pdf.exe.
+	AttachmentDoubleExtension = "DOUBLE_EXTENSION"
+	// AttachmentExecutable flags executables and scripts.
+	AttachmentExecutable = "EXECUTABLE"
+	// AttachmentMacroEnabled flags Office documents that can contain macros.
+	AttachmentMacroEnabled = "MACRO_ENABLED"
+	// AttachmentEncryptedArchive flags password protected archives.
+	AttachmentEncryptedArchive = "ENCRYPTED_ARCHIVE"
+	// AttachmentArchivedExecutable flags archives containing executables.
+	AttachmentArchivedExecutable = "ARCHIVED_EXECUTABLE"
+	// AttachmentTypeMismatch flags content that does not match its declared type.
+	AttachmentTypeMismatch = "TYPE_MISMATCH"
+)
+
+// maxAttachmentSniff is how much of an attachment is kept in memory for
+// inspection. Bigger attachments are only measured.
+const maxAttachmentSniff = 10 << 20
+
+var executableExtensions = map[string]bool{
+	".exe": true, ".scr": true, ".com": true, ".pif": true, ".bat": true, ".cmd": true,
+	".js": true, ".jse": true, ".vbs": true, ".vbe": true, ".wsf": true, ".hta": true,
+	".ps1": true, ".msi": true, ".jar": true, ".lnk": true, ".cpl": true, ".dll": true,
+	".iso": true, ".img": true, ".vhd": true,
+}
+
+// documentExtensions are the harmless looking extensions used to disguise
+// executables, e.g. invoice.pdf.exe.
+var documentExtensions = map[string]bool{
+	".pdf": true, ".doc": true, ".docx": true, ".xls": true, ".xlsx": true, ".ppt": true,
+	".pptx": true, ".odt": true, ".rtf": true, ".txt": true, ".csv": true, ".jpg": true,
+	".jpeg": true, ".png": true, ".gif": true, ".htm": true, ".html": true, ".zip": true,
+}
+
+var macroExtensions = map[string]bool{
+	".docm": true, ".dotm": true, ".xlsm": true, ".xltm": true, ".xlam": true,
+	".pptm": true, ".potm": true, ".ppsm": true, ".sldm": true,
+}
+
+// Attachment is the metadata of an email attachment. Its content is never
+// sent to the LLM, only the Text extracted from documents when enabled.
+type Attachment struct {
+	Filename     string
+	DeclaredType string
+	SniffedType  string
+	Size         int64
+	Flags        []string
+	Text         string
+}
+
+// String formats the attachment for the LLM prompt.
+func (a Attachment) String() string {
+	s := fmt.Sprintf("%q (declared %s, detected %s, %d bytes)", a.Filename, a.DeclaredType, a.SniffedType, a.Size)
+	if len(a.Flags) > 0 {
+		s += fmt.Sprintf(" [%s]", strings.Join(a.Flags, ", "))
+	}
+	return s
+}
+
+// attachmentFilename returns the filename of a MIME entity from its
+// Content-Disposition or Content-Type name parameter.
+func attachmentFilename(header headerGetter, params map[string]string) string {
+	if _, dispParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		if name := dispParams["filename"]; name != "" {
+			return decodeHeader(name)
+		}
+	}
+	return decodeHeader(params["name"])
+}
+
+// isAttachment returns true if the entity is marked as an attachment.
+func isAttachment(header headerGetter) bool {
+	disposition, _, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	return err == nil && disposition == "attachment"
+}
+
+// analyzeAttachment reads the (already transfer-decoded) body of an
+// attachment and flags anything suspicious. The text of documents up to
+// textLimit bytes is extracted, 0 disables the extraction.
+func analyzeAttachment(filename string, declaredType string, body io.Reader, textLimit int64) (Attachment, error) {
+	attachment := Attachment{Filename: filename, DeclaredType: declaredType}
+
+	var head bytes.Buffer
+	size, err := io.Copy(&head, io.LimitReader(body, maxAttachmentSniff))
+	if err != nil {
+		return attachment, fmt.Errorf("error reading attachment %q: %v", filename, err)
+	}
+	rest, err := io.Copy(io.Discard, body)
+	if err != nil {
+		return attachment, fmt.Errorf("error reading attachment %q: %v", filename, err)
+	}
+	attachment.Size = size + rest
+	data := head.Bytes()
+	attachment.SniffedType = sniffContentType(data)
+
+	ext := strings.ToLower(path.Ext(filename))
+	if executableExtensions[ext] {
+		attachment.Flags = append(attachment.Flags, AttachmentExecutable)
+		inner := strings.ToLower(path.Ext(strings.TrimSuffix(filename, path.Ext(filename))))
+		if documentExtensions[inner] {
+			attachment.Flags = append(attachment.Flags, AttachmentDoubleExtension)
+		}
+	}
+	macro := macroExtensions[ext]
+	if !compatibleTypes(declaredType, attachment.SniffedType) ||
+		(attachment.SniffedType == "application/x-msdownload" && !executableExtensions[ext]) {
+		attachment.Flags = append(attachment.Flags, AttachmentTypeMismatch)
+	}
+
+	if attachment.SniffedType == "application/zip" && rest == 0 {
+		if reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+			encrypted, executable := false, false
+			for _, f := range reader.File {
+				// Bit 0 of the general purpose flags marks encrypted entries.
+				encrypted = encrypted || f.Flags&0x1 != 0
+				executable = executable || executableExtensions[strings.ToLower(path.Ext(f.Name))]
+				// OOXML documents keep their macros in vbaProject.bin whatever
+				// their extension says.
+				macro = macro || strings.HasSuffix(strings.ToLower(f.Name), "vbaproject.bin")
+			}
+			if encrypted {
+				attachment.Flags = append(attachment.Flags, AttachmentEncryptedArchive)
+			}
+			if executable {
+				attachment.Flags = append(attachment.Flags, AttachmentArchivedExecutable)
+			}
+		}
+	}
+	if macro {
+		attachment.Flags = append(attachment.Flags, AttachmentMacroEnabled)
+	}
+	if rest == 0 && size <= textLimit {
+		attachment.Text, _ = extractAttachmentText(filename, attachment.SniffedType, data)
+	}
+	return attachment, nil
+}
+
+// sniffContentType detects the type of data, adding Windows executables that
+// http.DetectContentType does not know about.
+func sniffContentType(data []byte) string {
+	if bytes.HasPrefix(data, []byte("MZ")) {
+		return "application/x-msdownload"
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return sniffed
+}
+
+// compatibleTypes returns true if the detected type is consistent with the
+// declared one. Generic detections never conflict, and many document formats
+// are zip files.
+func compatibleTypes(declared string, sniffed string) bool {
+	switch {
+	case declared == "" || declared == sniffed:
+		return true
+	case declared == "application/octet-stream", sniffed == "application/octet-stream", strings.HasPrefix(sniffed, "text/plain"):
+		return true
+	case sniffed == "application/zip":
+		return strings.Contains(declared, "zip") || strings.Contains(declared, "openxmlformats") ||
+			strings.Contains(declared, "opendocument") || strings.Contains(declared, "java-archive") ||
+			strings.Contains(declared, "ms-excel") || strings.Contains(declared, "ms-word") ||
+			strings.Contains(declared, "ms-powerpoint")
+	case strings.HasPrefix(sniffed, "image/"):
+		return strings.HasPrefix(declared, "image/")
+	case strings.HasPrefix(sniffed, "text/"):
+		return strings.HasPrefix(declared, "text/")
+	}
+	return false
+}
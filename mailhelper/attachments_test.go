@@ -0,0 +1,155 @@
+package mailhelper
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// createZip builds a zip archive with the given file names, optionally
+// marking the entries as encrypted.
+func createZip(t *testing.T, encrypted bool, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range names {
+		header := &zip.FileHeader{Name: name, Method: zip.Store}
+		if encrypted {
+			header.Flags |= 0x1
+		}
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatalf("Error creating zip entry: %v", err)
+		}
+		if _, err := f.Write([]byte("content")); err != nil {
+			t.Fatalf("Error writing zip entry: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error closing zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestAnalyzeAttachment(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		declared string
+		data     []byte
+		sniffed  string
+		flags    []string
+	}{
+		{
+			name:     "plain pdf",
+			filename: "invoice.pdf",
+			declared: "application/pdf",
+			data:     []byte("%PDF-1.7\n..."),
+			sniffed:  "application/pdf",
+		},
+		{
+			name:     "double extension executable",
+			filename: "invoice.pdf.exe",
+			declared: "application/pdf",
+			data:     []byte("MZ\x90\x00"),
+			sniffed:  "application/x-msdownload",
+			flags:    []string{AttachmentExecutable, AttachmentDoubleExtension, AttachmentTypeMismatch},
+		},
+		{
+			name:     "executable disguised as pdf",
+			filename: "invoice.pdf",
+			declared: "application/octet-stream",
+			data:     []byte("MZ\x90\x00"),
+			sniffed:  "application/x-msdownload",
+			flags:    []string{AttachmentTypeMismatch},
+		},
+		{
+			name:     "macro enabled extension",
+			filename: "report.xlsm",
+			declared: "application/vnd.ms-excel.sheet.macroEnabled.12",
+			data:     createZip(t, false, "[Content_Types].xml", "xl/workbook.xml"),
+			sniffed:  "application/zip",
+			flags:    []string{AttachmentMacroEnabled},
+		},
+		{
+			name:     "docx hiding macros",
+			filename: "report.docx",
+			declared: "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			data:     createZip(t, false, "word/document.xml", "word/vbaProject.bin"),
+			sniffed:  "application/zip",
+			flags:    []string{AttachmentMacroEnabled},
+		},
+		{
+			name:     "encrypted archive with executable",
+			filename: "documents.zip",
+			declared: "application/zip",
+			data:     createZip(t, true, "scan.pdf.js"),
+			sniffed:  "application/zip",
+			flags:    []string{AttachmentEncryptedArchive, AttachmentArchivedExecutable},
+		},
+		{
+			name:     "image declared as pdf",
+			filename: "scan.pdf",
+			declared: "application/pdf",
+			data:     []byte("\x89PNG\r\n\x1a\n"),
+			sniffed:  "image/png",
+			flags:    []string{AttachmentTypeMismatch},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attachment, err := analyzeAttachment(tt.filename, tt.declared, bytes.NewReader(tt.data), 0)
+			if err != nil {
+				t.Fatalf("analyzeAttachment returned error: %v", err)
+			}
+			if attachment.Size != int64(len(tt.data)) {
+				t.Errorf("Expected size %d, got %d", len(tt.data), attachment.Size)
+			}
+			if attachment.SniffedType != tt.sniffed {
+				t.Errorf("Expected sniffed type %q, got %q", tt.sniffed, attachment.SniffedType)
+			}
+			if !reflect.DeepEqual(attachment.Flags, tt.flags) {
+				t.Errorf("Expected flags %v, got %v", tt.flags, attachment.Flags)
+			}
+		})
+	}
+}
+
+func TestParseEmailContentAttachments(t *testing.T) {
+	raw := "--b\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"See attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; name=\"notes.txt\"\r\n" +
+		"Content-Disposition: attachment; filename=\"notes.txt\"\r\n\r\n" +
+		"Attached text is not part of the body\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf; name=\"=?UTF-8?Q?factura_=E2=82=AC.pdf.exe?=\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		"TVqQAA==\r\n" +
+		"--b--\r\n"
+	content, err := ParseEmailContent(createEmail("multipart/mixed; boundary=b", []byte(raw)))
+	if err != nil {
+		t.Fatalf("ParseEmailContent returned error: %v", err)
+	}
+	if content.Text != "See attached" {
+		t.Errorf("Unexpected text %q", content.Text)
+	}
+	if len(content.Attachments) != 2 {
+		t.Fatalf("Expected 2 attachments, got %+v", content.Attachments)
+	}
+	exe := content.Attachments[1]
+	if exe.Filename != "factura €.pdf.exe" || exe.Size != 4 || exe.SniffedType != "application/x-msdownload" {
+		t.Errorf("Unexpected attachment %+v", exe)
+	}
+	if !strings.Contains(exe.String(), "DOUBLE_EXTENSION") {
+		t.Errorf("Expected flags in %q", exe.String())
+	}
+	signals := content.Signals()
+	want := []string{"attachment:executable", "attachment:double_extension", "attachment:type_mismatch"}
+	if !reflect.DeepEqual(signals, want) {
+		t.Errorf("Expected signals %v, got %v", want, signals)
+	}
+}
@@ -0,0 +1,269 @@
+package mailhelper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SignalWhitelistSpoof is raised by messages whose sender matches the
+// whitelist without being authenticated.
+const SignalWhitelistSpoof = "auth:whitelist_spoof"
+
+// AuthResult is the result of one authentication method in an
+// Authentication-Results header, e.g. "dkim=pass header.d=example.com".
+type AuthResult struct {
+	Method     string
+	Result     string
+	Properties map[string]string
+}
+
+// AuthResults are the results added by one authentication server, from an
+// Authentication-Results header or an ARC-Authentication-Results header
+// (with its ARC instance).
+type AuthResults struct {
+	AuthServID string
+	Instance   int
+	Results    []AuthResult
+}
+
+// String formats the results for the LLM prompt.
+func (a AuthResults) String() string {
+	parts := make([]string, 0, len(a.Results))
+	for _, r := range a.Results {
+		part := r.Method + "=" + r.Result
+		for _, key := range []string{"smtp.mailfrom", "header.d", "header.i", "header.from"} {
+			if value, ok := r.Properties[key]; ok {
+				part += " " + key + "=" + value
+			}
+		}
+		parts = append(parts, part)
+	}
+	if a.Instance > 0 {
+		return fmt.Sprintf("%s (ARC i=%d): %s", a.AuthServID, a.Instance, strings.Join(parts, "; "))
+	}
+	return a.AuthServID + ": " + strings.Join(parts, "; ")
+}
+
+// stripComments removes the RFC 5322 comments (nested parentheses) outside of
+// quoted strings.
+func stripComments(value string) string {
+	var builder strings.Builder
+	depth := 0
+	quoted := false
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"' && depth == 0:
+			quoted = !quoted
+		case r == '(' && !quoted:
+			depth++
+			continue
+		case r == ')' && !quoted && depth > 0:
+			depth--
+			builder.WriteRune(' ')
+			continue
+		}
+		if depth == 0 {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// splitQuoted splits value on sep outside of quoted strings.
+func splitQuoted(value string, sep func(rune) bool) []string {
+	var parts []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range value {
+		if r == '"' {
+			quoted = !quoted
+		}
+		if sep(r) && !quoted {
+			parts = append(parts, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(r)
+	}
+	return append(parts, current.String())
+}
+
+// ParseAuthenticationResults parses the value of an Authentication-Results
+// (RFC 8601) or ARC-Authentication-Results (RFC 8617) header.
+func ParseAuthenticationResults(value string) (AuthResults, error) {
+	var results AuthResults
+	segments := splitQuoted(stripComments(value), func(r rune) bool { return r == ';' })
+
+	first := strings.TrimSpace(segments[0])
+	if strings.HasPrefix(first, "i=") {
+		instance, err := strconv.Atoi(strings.TrimPrefix(first, "i="))
+		if err != nil {
+			return results, fmt.Errorf("invalid ARC instance %q", first)
+		}
+		results.Instance = instance
+		segments = segments[1:]
+		if len(segments) == 0 {
+			return results, fmt.Errorf("missing authserv-id")
+		}
+		first = strings.TrimSpace(segments[0])
+	}
+	// The authserv-id may be followed by a version number.
+	fields := strings.Fields(first)
+	if len(fields) == 0 {
+		return results, fmt.Errorf("missing authserv-id")
+	}
+	results.AuthServID = strings.ToLower(fields[0])
+
+	for _, segment := range segments[1:] {
+		tokens := splitQuoted(strings.TrimSpace(segment), func(r rune) bool { return r == ' ' || r == '\t' || r == '\r' || r == '\n' })
+		var result *AuthResult
+		for _, token := range tokens {
+			if token == "" {
+				continue
+			}
+			key, val, ok := strings.Cut(token, "=")
+			if !ok {
+				if token == "none" && result == nil {
+					break
+				}
+				return results, fmt.Errorf("invalid token %q", token)
+			}
+			val = strings.Trim(val, `"`)
+			if result == nil {
+				// The method may carry a version, e.g. dkim/1.
+				method, _, _ := strings.Cut(key, "/")
+				result = &AuthResult{Method: strings.ToLower(method), Result: strings.ToLower(val), Properties: map[string]string{}}
+				continue
+			}
+			result.Properties[strings.ToLower(key)] = val
+		}
+		if result != nil {
+			results.Results = append(results.Results, *result)
+		}
+	}
+	return results, nil
+}
+
+// GetAuthenticationResults returns the Authentication-Results and
+// ARC-Authentication-Results added by the trusted authserv-ids. Headers from
+// other servers are ignored, as anybody can add them to a message, and so are
+// all but the topmost header of every trusted server: the ones below were in
+// the message before it reached the server and may be forged.
+func (m *Email) GetAuthenticationResults(trusted []string) []AuthResults {
+	trustedIDs := map[string]bool{}
+	for _, id := range trusted {
+		trustedIDs[strings.ToLower(id)] = true
+	}
+
+	var all []AuthResults
+	// Header keys are stored in canonical form, hence Arc.
+	for _, header := range []string{"Authentication-Results", "Arc-Authentication-Results"} {
+		seen := map[string]bool{}
+		for _, value := range m.msg.Header[header] {
+			results, err := ParseAuthenticationResults(value)
+			if err != nil || !trustedIDs[results.AuthServID] || seen[results.AuthServID] {
+				continue
+			}
+			seen[results.AuthServID] = true
+			all = append(all, results)
+		}
+	}
+	return all
+}
+
+// AuthResultFor returns the first result of method added directly by a
+// trusted server, ignoring ARC sets.
+func AuthResultFor(results []AuthResults, method string) (AuthResult, bool) {
+	for _, r := range results {
+		if r.Instance > 0 {
+			continue
+		}
+		for _, result := range r.Results {
+			if result.Method == method {
+				return result, true
+			}
+		}
+	}
+	return AuthResult{}, false
+}
+
+// AuthSignals returns the signals of the authentication results, e.g.
+// "auth:dmarc=fail", usable in rule conditions. Results recorded in ARC sets
+// by earlier hops are prefixed with "arc:" instead.
+func AuthSignals(results []AuthResults) []string {
+	seen := map[string]bool{}
+	var signals []string
+	for _, r := range results {
+		prefix := "auth:"
+		if r.Instance > 0 {
+			prefix = "arc:"
+		}
+		for _, result := range r.Results {
+			signal := prefix + result.Method + "=" + result.Result
+			if !seen[signal] {
+				seen[signal] = true
+				signals = append(signals, signal)
+			}
+		}
+	}
+	return signals
+}
+
+// DKIMDomains returns the domains of the DKIM signatures that a trusted server
+// found valid.
+func DKIMDomains(results []AuthResults) []string {
+	var domains []string
+	for _, r := range results {
+		if r.Instance > 0 {
+			continue
+		}
+		for _, result := range r.Results {
+			if result.Method != "dkim" || result.Result != "pass" {
+				continue
+			}
+			domain := result.Properties["header.d"]
+			if domain == "" {
+				// header.i is an identity like user@sub.example.com or @example.com
+				_, domain, _ = strings.Cut(result.Properties["header.i"], "@")
+			}
+			if domain != "" {
+				domains = append(domains, strings.ToLower(domain))
+			}
+		}
+	}
+	return domains
+}
+
+// IsAuthenticatedSender returns true if a trusted server recorded a DMARC pass
+// for domain, the RFC 5322.From domain, or a valid DKIM signature is aligned
+// with it, sharing its organizational domain (relaxed alignment). dkimDomains
+// are the signing domains verified by other means, added to the ones of
+// results.
+func IsAuthenticatedSender(domain string, results []AuthResults, dkimDomains []string) bool {
+	for _, r := range results {
+		if r.Instance > 0 {
+			continue
+		}
+		for _, result := range r.Results {
+			if result.Method != "dmarc" || result.Result != "pass" {
+				continue
+			}
+			// Without header.from the result may be for any domain.
+			if from, ok := result.Properties["header.from"]; ok && domain != "" && strings.EqualFold(from, domain) {
+				return true
+			}
+		}
+	}
+	for _, signer := range append(DKIMDomains(results), dkimDomains...) {
+		if sameSite(signer, domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package mailhelper
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAuthenticationResults(t *testing.T) {
+	value := "mx.example.com 1; spf=pass (sender IP is 192.0.2.1) smtp.mailfrom=bank.com;\r\n" +
+		" dkim=pass (2048-bit key; unprotected) header.d=bank.com header.s=\"sel; 1\";\r\n" +
+		" dmarc=FAIL (p=REJECT sp=REJECT dis=NONE) header.from=bank.com"
+	results, err := ParseAuthenticationResults(value)
+	if err != nil {
+		t.Fatalf("ParseAuthenticationResults returned error: %v", err)
+	}
+	if results.AuthServID != "mx.example.com" || results.Instance != 0 {
+		t.Errorf("Unexpected authserv-id %q instance %d", results.AuthServID, results.Instance)
+	}
+	expected := []AuthResult{
+		{Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "bank.com"}},
+		{Method: "dkim", Result: "pass", Properties: map[string]string{"header.d": "bank.com", "header.s": "sel; 1"}},
+		{Method: "dmarc", Result: "fail", Properties: map[string]string{"header.from": "bank.com"}},
+	}
+	if !reflect.DeepEqual(results.Results, expected) {
+		t.Errorf("Unexpected results %+v", results.Results)
+	}
+	if s := results.String(); s != "mx.example.com: spf=pass smtp.mailfrom=bank.com; dkim=pass header.d=bank.com; dmarc=fail header.from=bank.com" {
+		t.Errorf("Unexpected string %q", s)
+	}
+}
+
+func TestParseAuthenticationResultsVariants(t *testing.T) {
+	arc, err := ParseAuthenticationResults("i=2; relay.example.org; dkim/1=pass header.i=@shop.com")
+	if err != nil {
+		t.Fatalf("ParseAuthenticationResults returned error: %v", err)
+	}
+	if arc.Instance != 2 || arc.AuthServID != "relay.example.org" || len(arc.Results) != 1 || arc.Results[0].Method != "dkim" {
+		t.Errorf("Unexpected ARC results %+v", arc)
+	}
+	if s := arc.String(); s != "relay.example.org (ARC i=2): dkim=pass header.i=@shop.com" {
+		t.Errorf("Unexpected string %q", s)
+	}
+
+	none, err := ParseAuthenticationResults("mx.example.com; none")
+	if err != nil || len(none.Results) != 0 {
+		t.Errorf("Expected no results, got %+v, %v", none, err)
+	}
+
+	for _, value := range []string{"", "i=x; mx.example.com; spf=pass", "i=1", "mx.example.com; spf"} {
+		if _, err := ParseAuthenticationResults(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestGetAuthenticationResults(t *testing.T) {
+	raw := "Authentication-Results: evil.example.net; dmarc=pass header.from=bank.com\r\n" +
+		"Authentication-Results: MX.example.com; spf=softfail smtp.mailfrom=bank.com; dmarc=fail header.from=bank.com\r\n" +
+		"ARC-Authentication-Results: i=1; mx.example.com; dmarc=pass header.from=bank.com\r\n" +
+		"Authentication-Results: mx.example.com; dkim=pass header.d=bank.com; dmarc=pass header.from=bank.com\r\n" +
+		"From: support@bank.com\r\n" +
+		"Subject: Verify your account\r\n" +
+		"\r\n" +
+		"Body"
+	email := createTestEmail(raw)
+
+	if results := email.GetAuthenticationResults(nil); len(results) != 0 {
+		t.Errorf("Expected no trusted results, got %+v", results)
+	}
+
+	results := email.GetAuthenticationResults([]string{"mx.example.com"})
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 trusted results, got %+v", results)
+	}
+	dmarc, ok := AuthResultFor(results, "dmarc")
+	if !ok || dmarc.Result != "fail" {
+		t.Errorf("Expected direct dmarc=fail, got %+v, %v", dmarc, ok)
+	}
+	if _, ok := AuthResultFor(results, "dkim"); ok {
+		t.Error("Expected the forged dkim result below the topmost header to be ignored")
+	}
+	signals := AuthSignals(results)
+	expected := []string{"auth:spf=softfail", "auth:dmarc=fail", "arc:dmarc=pass"}
+	if !reflect.DeepEqual(signals, expected) {
+		t.Errorf("AuthSignals() = %v, expected %v", signals, expected)
+	}
+}
+
+func TestIsAuthenticatedSender(t *testing.T) {
+	parse := func(value string) []AuthResults {
+		results, err := ParseAuthenticationResults(value)
+		if err != nil {
+			t.Fatalf("ParseAuthenticationResults returned error: %v", err)
+		}
+		return []AuthResults{results}
+	}
+	tests := []struct {
+		name        string
+		domain      string
+		results     []AuthResults
+		dkimDomains []string
+		want        bool
+	}{
+		{name: "no results", domain: "bank.com"},
+		{name: "dmarc pass", domain: "bank.com", results: parse("mx; dmarc=pass header.from=bank.com"), want: true},
+		{name: "dmarc pass without header.from", domain: "bank.com", results: parse("mx; dmarc=pass")},
+		{name: "dmarc pass for another domain", domain: "bank.com", results: parse("mx; dmarc=pass header.from=evil.com")},
+		{name: "dmarc fail", domain: "bank.com", results: parse("mx; dmarc=fail header.from=bank.com")},
+		{name: "aligned dkim", domain: "bank.com", results: parse("mx; dkim=pass header.d=mail.bank.com"), want: true},
+		{name: "dkim identity", domain: "bank.com", results: parse("mx; dkim=pass header.i=@bank.com"), want: true},
+		{name: "unaligned dkim", domain: "bank.com", results: parse("mx; dkim=pass header.d=mailer.net")},
+		{name: "failed dkim", domain: "bank.com", results: parse("mx; dkim=fail header.d=bank.com")},
+		{name: "arc is not enough", domain: "bank.com", results: parse("i=1; mx; dmarc=pass header.from=bank.com")},
+		{name: "locally verified dkim", domain: "bank.com", dkimDomains: []string{"bank.com"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsAuthenticatedSender(tt.domain, tt.results, tt.dkimDomains); got != tt.want {
+				t.Errorf("IsAuthenticatedSender() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
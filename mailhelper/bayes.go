@@ -0,0 +1,226 @@
+package mailhelper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+)
+
+const (
+	// maxBayesTokenLength is the longest word used as is, longer ones are
+	// reduced to their first letter and length.
+	maxBayesTokenLength = 20
+	// bayesInterestingTokens is how many tokens, the farthest from neutral,
+	// decide the score of a message.
+	bayesInterestingTokens = 15
+	// bayesMinDeviation ignores tokens too close to neutral to be telling.
+	bayesMinDeviation = 0.1
+	// bayesStrength and bayesAssumed shrink the probability of rare tokens
+	// towards neutral (Robinson's correction).
+	bayesStrength = 1.0
+	bayesAssumed  = 0.5
+)
+
+// BayesModel is a persisted naive Bayes token classifier, used to classify
+// the obvious messages locally before asking the LLM. It is not used until
+// it has been trained with MinMessages spam and ham messages.
+type BayesModel struct {
+	SpamTokens   map[string]int         `json:"spam_tokens"`
+	HamTokens    map[string]int         `json:"ham_tokens"`
+	SpamMessages int                    `json:"spam_messages"`
+	HamMessages  int                    `json:"ham_messages"`
+	Mailboxes    map[string]MailboxScan `json:"mailboxes"`
+	Filename     string                 `json:"-"`
+	MinMessages  int                    `json:"-"`
+	mu           sync.Mutex
+}
+
+// NewBayesModel loads the model stored in filename. A missing file is not an
+// error and results in an untrained model.
+func NewBayesModel(filename string, minMessages int) (*BayesModel, error) {
+	model := &BayesModel{
+		SpamTokens:  map[string]int{},
+		HamTokens:   map[string]int{},
+		Mailboxes:   map[string]MailboxScan{},
+		Filename:    filename,
+		MinMessages: minMessages,
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return model, nil
+	}
+	if err != nil {
+		return model, err
+	}
+	if err := json.Unmarshal(data, model); err != nil {
+		return model, fmt.Errorf("error parsing Bayes model %s: %v", filename, err)
+	}
+	if model.SpamTokens == nil {
+		model.SpamTokens = map[string]int{}
+	}
+	if model.HamTokens == nil {
+		model.HamTokens = map[string]int{}
+	}
+	if model.Mailboxes == nil {
+		model.Mailboxes = map[string]MailboxScan{}
+	}
+	return model, nil
+}
+
+// BayesTokens returns the distinct tokens of a message: the words of its
+// subject and body, the sender domain and the link and attachment metadata.
+func BayesTokens(sender *mail.Address, subject string, content *EmailContent) []string {
+	seen := map[string]bool{}
+	var tokens []string
+	add := func(token string) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	for _, word := range bayesWords(subject) {
+		add("subject:" + word)
+	}
+	if sender != nil {
+		add("from:" + addressDomain(sender.Address))
+	}
+	for _, word := range bayesWords(content.Text) {
+		add(word)
+	}
+	for _, domain := range linkDomains(content.Links) {
+		add("url:" + registrableDomain(NormalizeDomain(domain)))
+	}
+	for _, link := range content.Links {
+		for _, flag := range link.Flags {
+			add("url:flag:" + strings.ToLower(flag))
+		}
+	}
+	for _, attachment := range content.Attachments {
+		add("attachment:" + strings.ToLower(path.Ext(attachment.Filename)))
+		for _, flag := range attachment.Flags {
+			add("attachment:flag:" + strings.ToLower(flag))
+		}
+	}
+	return tokens
+}
+
+// messageBayesTokens returns the Bayes tokens of a fetched message.
+func messageBayesTokens(msg *imap.Message) ([]string, error) {
+	email, err := NewEmail(msg)
+	if err != nil {
+		return nil, err
+	}
+	// Messages without a valid sender are still worth learning from.
+	sender, _ := email.GetSender()
+	content, err := ParseEmailContent(email)
+	if err != nil {
+		return nil, err
+	}
+	return BayesTokens(sender, email.GetSubject(), content), nil
+}
+
+// bayesWords splits text in lowercase words of at least 3 characters.
+func bayesWords(text string) []string {
+	var words []string
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '€' && r != '\''
+	})
+	for _, word := range fields {
+		word = strings.Trim(word, "'")
+		length := len([]rune(word))
+		switch {
+		case length < 3:
+			continue
+		case length > maxBayesTokenLength:
+			// Long words are mostly encoded junk, only their shape matters.
+			first := []rune(word)[0]
+			words = append(words, fmt.Sprintf("skip:%c:%d", first, length/10*10))
+		default:
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Train adds the tokens of a message of the given class to the model.
+func (b *BayesModel) Train(tokens []string, spam bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counts := b.HamTokens
+	if spam {
+		counts = b.SpamTokens
+		b.SpamMessages++
+	} else {
+		b.HamMessages++
+	}
+	for _, token := range tokens {
+		counts[token]++
+	}
+}
+
+// Ready returns true once the model has been trained with enough messages
+// of both classes.
+func (b *BayesModel) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.SpamMessages >= b.MinMessages && b.HamMessages >= b.MinMessages &&
+		b.SpamMessages > 0 && b.HamMessages > 0
+}
+
+// Score returns the probability that a message with tokens is spam, combining
+// the tokens farthest from neutral. It returns false if the model is not
+// ready.
+func (b *BayesModel) Score(tokens []string) (float64, bool) {
+	if b == nil || !b.Ready() {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var probabilities []float64
+	for _, token := range tokens {
+		spam, ham := b.SpamTokens[token], b.HamTokens[token]
+		if spam+ham == 0 {
+			continue
+		}
+		spamFrequency := float64(spam) / float64(b.SpamMessages)
+		hamFrequency := float64(ham) / float64(b.HamMessages)
+		p := spamFrequency / (spamFrequency + hamFrequency)
+		n := float64(spam + ham)
+		p = (bayesStrength*bayesAssumed + n*p) / (bayesStrength + n)
+		if math.Abs(p-0.5) >= bayesMinDeviation {
+			probabilities = append(probabilities, math.Max(0.01, math.Min(0.99, p)))
+		}
+	}
+	sort.Slice(probabilities, func(i, j int) bool {
+		return math.Abs(probabilities[i]-0.5) > math.Abs(probabilities[j]-0.5)
+	})
+	if len(probabilities) > bayesInterestingTokens {
+		probabilities = probabilities[:bayesInterestingTokens]
+	}
+	logOdds := 0.0
+	for _, p := range probabilities {
+		logOdds += math.Log(p / (1 - p))
+	}
+	return 1 / (1 + math.Exp(-logOdds)), true
+}
+
+// Save writes the model to its file.
+func (b *BayesModel) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.Filename, data, 0644)
+}
@@ -0,0 +1,86 @@
+package mailhelper
+
+import (
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+// trainedBayesModel returns a model trained with a few obvious spam and ham
+// messages.
+func trainedBayesModel(t *testing.T, path string) *BayesModel {
+	t.Helper()
+	model, err := NewBayesModel(path, 3)
+	if err != nil {
+		t.Fatalf("NewBayesModel returned error: %v", err)
+	}
+	spam := []string{
+		"Cheap viagra pills, buy now with a huge discount",
+		"You won the lottery, claim your prize now",
+		"Buy cheap replica watches now, huge discount",
+	}
+	ham := []string{
+		"The meeting notes from yesterday are attached",
+		"Can we move the meeting to Thursday afternoon?",
+		"Here are the notes of the project review",
+	}
+	for _, text := range spam {
+		model.Train(BayesTokens(&mail.Address{Address: "promo@spam.example"}, "Offer", &EmailContent{Text: text}), true)
+	}
+	for _, text := range ham {
+		model.Train(BayesTokens(&mail.Address{Address: "boss@example.com"}, "Project", &EmailContent{Text: text}), false)
+	}
+	return model
+}
+
+func TestBayesTokens(t *testing.T) {
+	content := &EmailContent{
+		Text:  "Hello, it's a VERY good offer: $100 at aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa! Hello",
+		Links: []Link{{Destination: "https://www.xn--pypal-4ve.com/login", Host: "www.xn--pypal-4ve.com (www.pаypal.com)", Flags: []string{LinkPunycode}}},
+	}
+	got := BayesTokens(&mail.Address{Address: "promo@Spam.example"}, "Re: Offer", content)
+	want := []string{
+		"subject:offer", "from:spam.example", "hello", "it's", "very", "good", "offer", "$100",
+		"skip:a:30", "url:xn--pypal-4ve.com", "url:flag:punycode",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BayesTokens() = %q, want %q", got, want)
+	}
+}
+
+func TestBayesModel(t *testing.T) {
+	path := t.TempDir() + "/bayes.json"
+	model, err := NewBayesModel(path, 3)
+	if err != nil {
+		t.Fatalf("NewBayesModel returned error: %v", err)
+	}
+	if _, ok := model.Score([]string{"cheap"}); ok {
+		t.Error("Expected an untrained model not to score")
+	}
+
+	model = trainedBayesModel(t, path)
+	spamTokens := BayesTokens(&mail.Address{Address: "deals@spam.example"}, "Offer", &EmailContent{Text: "Huge discount on cheap pills, buy now"})
+	hamTokens := BayesTokens(&mail.Address{Address: "boss@example.com"}, "Project", &EmailContent{Text: "Notes of the meeting on Thursday"})
+	spamProbability, ok := model.Score(spamTokens)
+	if !ok || spamProbability < 0.99 {
+		t.Errorf("Expected spam, got %v, %v", spamProbability, ok)
+	}
+	hamProbability, ok := model.Score(hamTokens)
+	if !ok || hamProbability > 0.01 {
+		t.Errorf("Expected ham, got %v, %v", hamProbability, ok)
+	}
+	if probability, _ := model.Score([]string{"unknown", "words"}); probability != 0.5 {
+		t.Errorf("Expected unknown words to be neutral, got %v", probability)
+	}
+
+	if err := model.Save(); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	loaded, err := NewBayesModel(path, 3)
+	if err != nil {
+		t.Fatalf("NewBayesModel returned error: %v", err)
+	}
+	if probability, ok := loaded.Score(spamTokens); !ok || probability != spamProbability {
+		t.Errorf("Expected the loaded model to score %v, got %v, %v", spamProbability, probability, ok)
+	}
+}
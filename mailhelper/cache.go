@@ -0,0 +1,185 @@
+package mailhelper
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"llm-antispam/llm"
+)
+
+var (
+	// urlQueryRe matches the query and fragment of URLs, where campaigns put
+	// their per-recipient tracking tokens.
+	urlQueryRe = regexp.MustCompile(`(https?://[^\s?#"'<>]+)[?#][^\s"'<>]*`)
+	// hexTokenRe matches long hexadecimal tokens like UUIDs and tracking IDs.
+	hexTokenRe   = regexp.MustCompile(`\b[0-9a-f]{8}(?:-?[0-9a-f]{4}){3}-?[0-9a-f]{12}\b|\b[0-9a-f]{16,}\b`)
+	letterRe     = regexp.MustCompile(`[a-f]`)
+	whitespaceRe = regexp.MustCompile(`\s+`)
+)
+
+// CachedVerdict is a previous classification stored in the VerdictCache.
+type CachedVerdict struct {
+	Score     float64   `json:"score"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// VerdictCache is a persistent cache of LLM verdicts keyed by a hash of the
+// normalized cleaned email, so repeated bulk mail is only classified once.
+type VerdictCache struct {
+	Entries    map[string]CachedVerdict `json:"entries"`
+	Filename   string                   `json:"-"`
+	TTL        time.Duration            `json:"-"`
+	MaxEntries int                      `json:"-"`
+
+	// recent orders the keys from the most to the least recently used, the
+	// least recently used entries are evicted first.
+	recent   *list.List
+	elements map[string]*list.Element
+	mu       sync.Mutex
+}
+
+// NewVerdictCache loads the cache stored in filename. A missing file is not an
+// error, the cache simply starts empty.
+func NewVerdictCache(filename string, ttl time.Duration, maxEntries int) (*VerdictCache, error) {
+	cache := &VerdictCache{
+		Entries:    map[string]CachedVerdict{},
+		Filename:   filename,
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		recent:     list.New(),
+		elements:   map[string]*list.Element{},
+	}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, err
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		return cache, err
+	}
+	if cache.Entries == nil {
+		cache.Entries = map[string]CachedVerdict{}
+	}
+	// Without a record of their use, the newest entries count as the most
+	// recently used.
+	keys := make([]string, 0, len(cache.Entries))
+	for key := range cache.Entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return cache.Entries[keys[i]].CreatedAt.After(cache.Entries[keys[j]].CreatedAt)
+	})
+	for _, key := range keys {
+		cache.elements[key] = cache.recent.PushBack(key)
+	}
+	return cache, nil
+}
+
+// CacheKey returns the cache key of a cleaned email for the given model. Case,
+// whitespace and the known volatile tokens (URL query strings, UUIDs and long
+// hexadecimal IDs) are normalized so the same campaign sent with different
+// tracking tokens shares the same key. Other digits are kept, as messages
+// differing only in codes or amounts may deserve different verdicts.
+func CacheKey(model string, cleanedMail string) string {
+	normalized := strings.ToLower(cleanedMail)
+	normalized = urlQueryRe.ReplaceAllString(normalized, "$1?")
+	normalized = hexTokenRe.ReplaceAllStringFunc(normalized, func(token string) string {
+		// Plain numbers are not tracking IDs.
+		if !letterRe.MatchString(token) {
+			return token
+		}
+		return "<id>"
+	})
+	normalized = whitespaceRe.ReplaceAllString(normalized, " ")
+	normalized = strings.TrimSpace(normalized)
+
+	sum := sha256.Sum256([]byte(model + "\x00" + llm.PromptVersion + "\x00" + normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the cached verdict for key if present and not expired.
+func (c *VerdictCache) Get(key string) (CachedVerdict, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	verdict, ok := c.Entries[key]
+	if !ok {
+		return CachedVerdict{}, false
+	}
+	if c.expired(verdict, time.Now()) {
+		c.remove(key)
+		return CachedVerdict{}, false
+	}
+	c.touch(key)
+	return verdict, true
+}
+
+// Put stores a verdict, evicting the least recently used entries if the cache
+// is full.
+func (c *VerdictCache) Put(key string, score float64, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Entries[key] = CachedVerdict{Score: score, Reason: reason, CreatedAt: time.Now()}
+	c.touch(key)
+	c.evict()
+}
+
+// Save drops expired entries and writes the cache to disk.
+func (c *VerdictCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, verdict := range c.Entries {
+		if c.expired(verdict, now) {
+			c.remove(key)
+		}
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.Filename, data, 0644)
+}
+
+func (c *VerdictCache) expired(verdict CachedVerdict, now time.Time) bool {
+	return c.TTL > 0 && now.Sub(verdict.CreatedAt) > c.TTL
+}
+
+// touch marks key as the most recently used.
+func (c *VerdictCache) touch(key string) {
+	if element, ok := c.elements[key]; ok {
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.elements[key] = c.recent.PushFront(key)
+}
+
+// remove deletes the entry of key.
+func (c *VerdictCache) remove(key string) {
+	if element, ok := c.elements[key]; ok {
+		c.recent.Remove(element)
+		delete(c.elements, key)
+	}
+	delete(c.Entries, key)
+}
+
+// evict removes the least recently used entries until the cache fits in
+// MaxEntries.
+func (c *VerdictCache) evict() {
+	for c.MaxEntries > 0 && len(c.Entries) > c.MaxEntries {
+		c.remove(c.recent.Back().Value.(string))
+	}
+}
@@ -0,0 +1,79 @@
+package mailhelper
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	a := CacheKey("ollama/gemma3:1b", "FROM: a@b.com\nOrder  shipped https://shop.example/track?id=123&u=9f8e7d6c5b4a39281706f5e4d3c2b1a0")
+	b := CacheKey("ollama/gemma3:1b", "from: a@b.com order SHIPPED https://shop.example/track?id=456")
+	if a != b {
+		t.Errorf("Expected emails differing in tracking tokens to share a key")
+	}
+	c := CacheKey("openai/gpt-4o", "FROM: a@b.com\nOrder  shipped https://shop.example/track?id=123")
+	if a == c {
+		t.Errorf("Expected different models to produce different keys")
+	}
+	d := CacheKey("ollama/gemma3:1b", "Ref 3f2504e0-4f89-11d3-9a0c-0305e82c3301: pay $100")
+	e := CacheKey("ollama/gemma3:1b", "Ref 7c9e6679-7425-40de-944b-e07fc1f90ae7: pay $100")
+	if d != e {
+		t.Errorf("Expected emails differing in UUIDs to share a key")
+	}
+	f := CacheKey("ollama/gemma3:1b", "Ref 3f2504e0-4f89-11d3-9a0c-0305e82c3301: pay $9000")
+	if d == f {
+		t.Errorf("Expected emails with different amounts to have different keys")
+	}
+	if CacheKey("m", "Your code is 123456") == CacheKey("m", "Your code is 654321") {
+		t.Errorf("Expected emails with different codes to have different keys")
+	}
+}
+
+func TestVerdictCache(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cache.json")
+
+	cache, err := NewVerdictCache(filename, time.Hour, 2)
+	if err != nil {
+		t.Fatalf("NewVerdictCache returned error: %v", err)
+	}
+	if _, ok := cache.Get("missing"); ok {
+		t.Errorf("Expected empty cache")
+	}
+
+	cache.Put("first", 9, "SPAM")
+	time.Sleep(time.Millisecond)
+	cache.Put("second", 1, "HAM")
+	time.Sleep(time.Millisecond)
+	// Using first makes second the least recently used.
+	if _, ok := cache.Get("first"); !ok {
+		t.Fatalf("Expected first entry to be cached")
+	}
+	cache.Put("third", 8, "SPAM")
+
+	if _, ok := cache.Get("second"); ok {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	reloaded, err := NewVerdictCache(filename, time.Hour, 2)
+	if err != nil {
+		t.Fatalf("NewVerdictCache returned error: %v", err)
+	}
+	verdict, ok := reloaded.Get("third")
+	if !ok {
+		t.Fatalf("Expected entry to survive reload")
+	}
+	if verdict.Score != 8 || verdict.Reason != "SPAM" {
+		t.Errorf("Unexpected verdict %+v", verdict)
+	}
+
+	// Expire everything.
+	reloaded.TTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, ok := reloaded.Get("first"); ok {
+		t.Errorf("Expected expired entry to be ignored")
+	}
+}
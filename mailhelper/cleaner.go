@@ -6,7 +6,9 @@ import (
 	"io"
 	"mime"
 	"mime/multipart"
+	"net/mail"
 	"strings"
+	"unicode/utf8"
 
 	"golang.org/x/net/html"
 )
@@ -29,61 +31,279 @@ func extractText(n *html.Node) string {
 	return buf.String()
 }
 
+// maxMIMEDepth limits how deep nested multiparts and encapsulated messages are
+// walked, so a malicious message cannot exhaust the stack.
+const maxMIMEDepth = 10
+
+// alternativeRank returns how preferred a part of a multipart/alternative is.
+// HTML is what mail clients show, so it wins over plain text. Nested
+// multiparts (usually multipart/related) generally wrap the HTML version.
+func alternativeRank(mediaType string) int {
+	switch {
+	case mediaType == "text/html", strings.HasPrefix(mediaType, "multipart/"):
+		return 2
+	case mediaType == "text/plain":
+		return 1
+	default:
+		return 0
+	}
+}
+
+const (
+	// MIMETooDeep flags MIME structures nested deeper than maxMIMEDepth.
+	MIMETooDeep = "TOO_DEEP"
+	// MIMEBadMultipart flags multipart bodies that cannot be split in parts.
+	MIMEBadMultipart = "BAD_MULTIPART"
+	// MIMEBadEncapsulated flags encapsulated messages that cannot be parsed.
+	MIMEBadEncapsulated = "BAD_ENCAPSULATED"
+	// MIMEBadEncoding flags text parts whose encoding cannot be decoded.
+	MIMEBadEncoding = "BAD_ENCODING"
+	// MIMEBadAttachment flags attachments that cannot be read.
+	MIMEBadAttachment = "BAD_ATTACHMENT"
+	// MIMEBadContentType flags messages whose Content-Type cannot be parsed,
+	// read as plain text instead.
+	MIMEBadContentType = "BAD_CONTENT_TYPE"
+)
+
+// EmailContent is what is extracted from an email body for the classifier.
+type EmailContent struct {
+	Text        string
+	Links       []Link
+	Attachments []Attachment
+	// MIMEFlags are the problems found in the MIME structure, whose broken
+	// parts were skipped.
+	MIMEFlags []string
+}
+
+// contentWalker walks the MIME tree of an email collecting everything but the
+// text, which is written to the builder of each call. Broken parts are skipped
+// and flagged, as malformed messages are themselves a sign of spam.
+type contentWalker struct {
+	links       []Link
+	attachments []Attachment
+	flags       []string
+	textLimit   int64
+}
+
+// flag records a problem of the MIME structure once.
+func (w *contentWalker) flag(flag string) {
+	for _, f := range w.flags {
+		if f == flag {
+			return
+		}
+	}
+	w.flags = append(w.flags, flag)
+}
+
+// walkMultipart writes the text of the parts of a multipart body to builder.
+// Every part is walked, except in multipart/alternative where only the
+// preferred alternative is used.
+func (w *contentWalker) walkMultipart(builder *strings.Builder, mediaType string, body io.Reader, boundary string, depth int) {
+	if depth > maxMIMEDepth {
+		w.flag(MIMETooDeep)
+		return
+	}
+	var best string
+	bestRank := 0
+
+	mr := multipart.NewReader(body, boundary)
+	for {
+		// Raw parts keep their Content-Transfer-Encoding, decoded by walkEntity.
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Keep what was read of the previous parts.
+			w.flag(MIMEBadMultipart)
+			break
+		}
+
+		if mediaType != "multipart/alternative" {
+			w.walkEntity(builder, part.Header, part, depth+1)
+			continue
+		}
+
+		var alternative strings.Builder
+		w.walkEntity(&alternative, part.Header, part, depth+1)
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if partType == "" {
+			partType = "text/plain"
+		}
+		// The last alternative is the preferred one on ties, as per RFC 2046.
+		if rank := alternativeRank(partType); rank > 0 && rank >= bestRank && alternative.Len() > 0 {
+			best = alternative.String()
+			bestRank = rank
+		}
+	}
+	builder.WriteString(best)
+}
+
+// isTextContainer returns true for the content types walked for text, every
+// other type is handled as an attachment.
+func isTextContainer(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "multipart/") || mediaType == "message/rfc822" ||
+		mediaType == "text/html" || mediaType == "text/plain"
+}
+
+// walkEntity writes the text of a MIME entity to builder, descending into
+// multiparts and encapsulated messages. Attachments are only analyzed.
+func (w *contentWalker) walkEntity(builder *strings.Builder, header headerGetter, body io.Reader, depth int) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Unparsable parts are skipped instead of failing the whole email.
+		return
+	}
+
+	if mediaType == "message/rfc822" && isAttachment(header) {
+		// Forwarded messages are walked whatever their disposition, as their
+		// text and links are what the recipient is asked to read, and listed
+		// as attachments too.
+		data, err := io.ReadAll(decodeTransferEncoding(body, header.Get("Content-Transfer-Encoding")))
+		if err != nil {
+			w.flag(MIMEBadEncapsulated)
+			return
+		}
+		w.addAttachment(attachmentFilename(header, params), mediaType, bytes.NewReader(data))
+		w.walkEncapsulated(builder, bytes.NewReader(data), depth)
+		return
+	}
+	if isAttachment(header) || !isTextContainer(mediaType) {
+		w.addAttachment(attachmentFilename(header, params), mediaType,
+			decodeTransferEncoding(body, header.Get("Content-Transfer-Encoding")))
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		w.walkMultipart(builder, mediaType, body, params["boundary"], depth)
+	case mediaType == "message/rfc822":
+		w.walkEncapsulated(builder, decodeTransferEncoding(body, header.Get("Content-Transfer-Encoding")), depth)
+	case mediaType == "text/html", mediaType == "text/plain":
+		data, err := readText(header, body, mediaType, params)
+		if err != nil {
+			w.flag(MIMEBadEncoding)
+			return
+		}
+		w.writeText(builder, mediaType, data)
+	}
+}
+
+// walkEncapsulated writes the headers and text of an encapsulated message,
+// whose body is already transfer-decoded, to builder.
+func (w *contentWalker) walkEncapsulated(builder *strings.Builder, body io.Reader, depth int) {
+	if depth >= maxMIMEDepth {
+		w.flag(MIMETooDeep)
+		return
+	}
+	msg, err := mail.ReadMessage(body)
+	if err != nil {
+		w.flag(MIMEBadEncapsulated)
+		return
+	}
+	fmt.Fprintf(builder, "\n--- Encapsulated message ---\nFROM: %s\nSUBJECT: %s\n\n",
+		decodeHeader(msg.Header.Get("From")), decodeHeader(msg.Header.Get("Subject")))
+	w.walkEntity(builder, msg.Header, msg.Body, depth+1)
+}
+
+// addAttachment analyzes the transfer-decoded body of an attachment. Unreadable
+// attachments are kept and flagged, as their name and declared type are still
+// worth showing.
+func (w *contentWalker) addAttachment(filename string, mediaType string, body io.Reader) {
+	attachment, err := analyzeAttachment(filename, mediaType, body, w.textLimit)
+	if err != nil {
+		w.flag(MIMEBadAttachment)
+	}
+	w.attachments = append(w.attachments, attachment)
+}
+
+// writeText writes the text of an HTML or plain text body to builder and
+// collects its links.
+func (w *contentWalker) writeText(builder *strings.Builder, mediaType string, data []byte) {
+	if mediaType != "text/html" {
+		// For plain text, print as is.
+		builder.Write(data)
+		w.links = append(w.links, extractTextLinks(string(data))...)
+		return
+	}
+	// Parse the HTML part and extract plain text. The parser recovers from
+	// any malformed markup, it only fails on read errors.
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		w.flag(MIMEBadEncoding)
+		return
+	}
+	builder.WriteString(extractText(doc))
+	w.links = append(w.links, extractLinks(doc)...)
+}
+
+// looksLikeText returns true if data can be sent to the LLM as text.
+func looksLikeText(data []byte) bool {
+	return utf8.Valid(data) && !bytes.ContainsRune(data, 0)
+}
+
 func CleanEmailBody(email *Email) (string, error) {
+	content, err := ParseEmailContent(email)
+	if err != nil {
+		return "", err
+	}
+	return content.Text, nil
+}
+
+// ParseEmailContent extracts the text of the email body and the metadata used
+// by the classifier, like the links and attachments.
+func ParseEmailContent(email *Email) (*EmailContent, error) {
+	return ParseEmailContentWithText(email, 0)
+}
+
+// ParseEmailContentWithText works like ParseEmailContent and also extracts the
+// text of PDF, DOCX and HTML attachments up to textLimit bytes.
+func ParseEmailContentWithText(email *Email, textLimit int64) (*EmailContent, error) {
 	var builder strings.Builder
+	walker := &contentWalker{textLimit: textLimit}
 	ctHeader := email.GetHeader("Content-Type")
+	if ctHeader == "" {
+		// RFC 2045 default for messages without Content-Type.
+		ctHeader = "text/plain; charset=us-ascii"
+	}
 	mediaType, params, err := mime.ParseMediaType(ctHeader)
 	if err != nil {
-		return "", fmt.Errorf("error parsing Content-Type header: %v", err)
-	}
-
-	// If the email is multipart, process each part.
-	if strings.HasPrefix(mediaType, "multipart/") {
-		mr := multipart.NewReader(email.msg.Body, params["boundary"])
-		for {
-			part, err := mr.NextPart()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return "", err
-			}
-
-			partCt := part.Header.Get("Content-Type")
-			partData, err := io.ReadAll(part)
-			if err != nil {
-				return "", err
-			}
-
-			if strings.Contains(partCt, "text/html") {
-				// Parse the HTML part and extract plain text.
-				doc, err := html.Parse(bytes.NewReader(partData))
-				if err != nil {
-					return "", fmt.Errorf("error parsing HTML part: %v", err)
-				}
-				cleanText := extractText(doc)
-				builder.WriteString(cleanText)
-			} else if strings.Contains(partCt, "text/plain") {
-				// For plain text, print as is.
-				builder.WriteString(string(partData))
-			}
+		walker.flag(MIMEBadContentType)
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"), mediaType == "message/rfc822":
+		// Walk the whole MIME tree.
+		walker.walkEntity(&builder, email.msg.Header, email.msg.Body, 0)
+	case strings.HasPrefix(mediaType, "text/"):
+		if body, err := readText(email.msg.Header, email.msg.Body, mediaType, params); err != nil {
+			walker.flag(MIMEBadEncoding)
+		} else {
+			walker.writeText(&builder, mediaType, body)
 		}
-	} else {
-		// Single-part email: process based on the Content-Type.
-		body, err := email.GetBody()
+	default:
+		// Other single-part bodies, like a lone PDF or executable, are
+		// analyzed as attachments. The ones that decode to text are also used
+		// as is.
+		data, err := io.ReadAll(decodeTransferEncoding(email.msg.Body, email.GetHeader("Content-Transfer-Encoding")))
 		if err != nil {
-			return "", err
+			walker.flag(MIMEBadEncoding)
+			break
 		}
-		if strings.Contains(ctHeader, "text/html") {
-			doc, err := html.Parse(bytes.NewReader(body))
-			if err != nil {
-				return "", fmt.Errorf("error parsing HTML: %v", err)
-			}
-			cleanText := extractText(doc)
-			builder.WriteString(cleanText)
-		} else {
-			fmt.Println(string(body))
+		walker.addAttachment(attachmentFilename(email.msg.Header, params), mediaType, bytes.NewReader(data))
+		if text, err := decodeCharset(data, params["charset"], mediaType); err == nil && looksLikeText(text) {
+			walker.writeText(&builder, mediaType, text)
 		}
 	}
-	return builder.String(), nil
+	return &EmailContent{
+		Text:        builder.String(),
+		Links:       dedupLinks(walker.links),
+		Attachments: walker.attachments,
+		MIMEFlags:   walker.flags,
+	}, nil
 }
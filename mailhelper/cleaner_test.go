@@ -7,6 +7,8 @@ import (
 	"mime/multipart"
 	"net/mail"
 	"net/textproto"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -151,13 +153,168 @@ func TestCleanEmailBody(t *testing.T) {
 		if err != nil {
 			t.Fatalf("CleanEmailBody returned error: %v", err)
 		}
-		// Expected: the HTML part produces "Hello World " and the plain text part is appended.
-		expected := "Hello World Plain text content"
+		// Expected: only the preferred HTML alternative is used.
+		expected := "Hello World "
 		if result != expected {
 			t.Errorf("Expected %q but got %q", expected, result)
 		}
 	})
 
+	t.Run("nested multipart with encapsulated message", func(t *testing.T) {
+		// multipart/mixed -> [multipart/alternative -> [text/plain, multipart/related -> text/html], message/rfc822]
+		raw := "--mixed\r\n" +
+			"Content-Type: multipart/alternative; boundary=alt\r\n\r\n" +
+			"--alt\r\n" +
+			"Content-Type: text/plain\r\n\r\n" +
+			"Plain version\r\n" +
+			"--alt\r\n" +
+			"Content-Type: multipart/related; boundary=rel\r\n\r\n" +
+			"--rel\r\n" +
+			"Content-Type: text/html\r\n\r\n" +
+			"<p>Nested <b>HTML</b></p>\r\n" +
+			"--rel\r\n" +
+			"Content-Type: image/png\r\n\r\n" +
+			"PNGDATA\r\n" +
+			"--rel--\r\n" +
+			"--alt--\r\n" +
+			"--mixed\r\n" +
+			"Content-Type: message/rfc822\r\n\r\n" +
+			"From: phisher@evil.com\r\n" +
+			"Subject: Verify your account\r\n\r\n" +
+			"Click here\r\n" +
+			"--mixed--\r\n"
+		email := createEmail("multipart/mixed; boundary=mixed", []byte(raw))
+
+		result, err := CleanEmailBody(email)
+		if err != nil {
+			t.Fatalf("CleanEmailBody returned error: %v", err)
+		}
+		expected := "Nested HTML \n--- Encapsulated message ---\nFROM: phisher@evil.com\nSUBJECT: Verify your account\n\nClick here"
+		if result != expected {
+			t.Errorf("Expected %q but got %q", expected, result)
+		}
+	})
+
+	t.Run("multipart with encoded parts", func(t *testing.T) {
+		raw := "--b\r\n" +
+			"Content-Type: text/plain; charset=gb2312\r\n" +
+			"Content-Transfer-Encoding: base64\r\n\r\n" +
+			"xOO6w8rAvec=\r\n" +
+			"--b\r\n" +
+			"Content-Type: text/html; charset=iso-8859-1\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+			"<p>Caf=E9 =E0 la cr=E8me</p>\r\n" +
+			"--b--\r\n"
+		email := createEmail("multipart/mixed; boundary=b", []byte(raw))
+
+		result, err := CleanEmailBody(email)
+		if err != nil {
+			t.Fatalf("CleanEmailBody returned error: %v", err)
+		}
+		expected := "你好世界Café à la crème "
+		if result != expected {
+			t.Errorf("Expected %q but got %q", expected, result)
+		}
+	})
+
+	t.Run("single-part base64 html email", func(t *testing.T) {
+		email := createTestEmail("Content-Type: text/html; charset=windows-1252\r\n" +
+			"Content-Transfer-Encoding: base64\r\n\r\n" +
+			"PHA+k0ZyZWWUIIAxMDA8L3A+")
+
+		result, err := CleanEmailBody(email)
+		if err != nil {
+			t.Fatalf("CleanEmailBody returned error: %v", err)
+		}
+		expected := "“Free” €100 "
+		if result != expected {
+			t.Errorf("Expected %q but got %q", expected, result)
+		}
+	})
+
+	t.Run("multipart nested too deep", func(t *testing.T) {
+		raw := "Hello"
+		for i := 0; i <= maxMIMEDepth+1; i++ {
+			raw = fmt.Sprintf("--b%d\r\nContent-Type: multipart/mixed; boundary=b%d\r\n\r\n%s\r\n--b%d--\r\n", i, i-1, raw, i)
+		}
+		email := createEmail(fmt.Sprintf("multipart/mixed; boundary=b%d", maxMIMEDepth+1), []byte(raw))
+		content, err := ParseEmailContent(email)
+		if err != nil {
+			t.Fatalf("ParseEmailContent returned error: %v", err)
+		}
+		if !reflect.DeepEqual(content.MIMEFlags, []string{MIMETooDeep}) {
+			t.Errorf("Expected the too deep flag, got %v", content.MIMEFlags)
+		}
+	})
+
+	t.Run("broken parts are skipped and flagged", func(t *testing.T) {
+		raw := "--b\r\nContent-Type: text/plain\r\n\r\nReadable part\r\n" +
+			"--b\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\n!!!not base64!!!\r\n" +
+			"--b\r\nContent-Type: message/rfc822\r\n\r\nnot a header line\r\n" +
+			"--b\r\nContent-Type: application/pdf; name=a.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\n!!!\r\n" +
+			"--b--\r\n"
+		content, err := ParseEmailContent(createEmail("multipart/mixed; boundary=b", []byte(raw)))
+		if err != nil {
+			t.Fatalf("ParseEmailContent returned error: %v", err)
+		}
+		if content.Text != "Readable part" {
+			t.Errorf("Expected the readable part only, got %q", content.Text)
+		}
+		if len(content.Attachments) != 1 || content.Attachments[0].Filename != "a.pdf" {
+			t.Errorf("Expected the unreadable attachment to be kept, got %+v", content.Attachments)
+		}
+		if !reflect.DeepEqual(content.MIMEFlags, []string{MIMEBadEncoding, MIMEBadEncapsulated, MIMEBadAttachment}) {
+			t.Errorf("Expected the bad encoding, encapsulated and attachment flags, got %v", content.MIMEFlags)
+		}
+		signals := content.Signals()
+		if !reflect.DeepEqual(signals, []string{"mime:bad_encoding", "mime:bad_encapsulated", "mime:bad_attachment"}) {
+			t.Errorf("Unexpected signals %v", signals)
+		}
+	})
+
+	t.Run("forwarded message attachment", func(t *testing.T) {
+		raw := "--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+			"--b\r\nContent-Type: message/rfc822\r\nContent-Disposition: attachment; filename=phish.eml\r\n\r\n" +
+			"From: security@bank.example\r\nSubject: Verify\r\n\r\nLogin at https://evil.example/login\r\n" +
+			"--b--\r\n"
+		content, err := ParseEmailContent(createEmail("multipart/mixed; boundary=b", []byte(raw)))
+		if err != nil {
+			t.Fatalf("ParseEmailContent returned error: %v", err)
+		}
+		if !strings.Contains(content.Text, "Login at https://evil.example/login") || len(content.Links) != 1 {
+			t.Errorf("Expected the forwarded message to be walked, got %q and %+v", content.Text, content.Links)
+		}
+		if len(content.Attachments) != 1 || content.Attachments[0].Filename != "phish.eml" {
+			t.Errorf("Expected the forwarded message to be listed as an attachment, got %+v", content.Attachments)
+		}
+	})
+
+	t.Run("single-part executable analyzed as an attachment", func(t *testing.T) {
+		content, err := ParseEmailContent(createEmail("application/x-msdownload; name=\"invoice.pdf.exe\"", []byte("MZ\x90\x00")))
+		if err != nil {
+			t.Fatalf("ParseEmailContent returned error: %v", err)
+		}
+		if len(content.Attachments) != 1 || !reflect.DeepEqual(content.Attachments[0].Flags, []string{AttachmentExecutable, AttachmentDoubleExtension}) {
+			t.Errorf("Expected the flagged executable, got %+v", content.Attachments)
+		}
+		if content.Text != "" {
+			t.Errorf("Expected no text, got %q", content.Text)
+		}
+	})
+
+	t.Run("unparsable content type read as plain text", func(t *testing.T) {
+		content, err := ParseEmailContent(createEmail("text/html; charset=\"utf-8", []byte("Visit https://evil.example now")))
+		if err != nil {
+			t.Fatalf("ParseEmailContent returned error: %v", err)
+		}
+		if content.Text != "Visit https://evil.example now" || len(content.Links) != 1 {
+			t.Errorf("Expected the body as plain text with its link, got %q and %+v", content.Text, content.Links)
+		}
+		if !reflect.DeepEqual(content.Signals(), []string{"mime:bad_content_type"}) {
+			t.Errorf("Expected the bad content type signal, got %v", content.Signals())
+		}
+	})
+
 	t.Run("single-part html email", func(t *testing.T) {
 		// Build a single-part HTML email.
 		htmlContent := `<html><body><p>Hello <i>Single Part</i></p></body></html>`
@@ -176,7 +333,6 @@ func TestCleanEmailBody(t *testing.T) {
 	})
 
 	t.Run("single-part plain text email", func(t *testing.T) {
-		// For non-HTML single-part emails, CleanEmailBody doesn't append the body text (it only prints it).
 		textContent := "Just plain text"
 		contentType := "text/plain; charset=utf-8"
 		email := createEmail(contentType, []byte(textContent))
@@ -185,10 +341,47 @@ func TestCleanEmailBody(t *testing.T) {
 		if err != nil {
 			t.Fatalf("CleanEmailBody returned error: %v", err)
 		}
-		// Expected output is empty because the plain text branch in single-part doesn't write to the builder.
-		expected := ""
+		expected := "Just plain text"
 		if result != expected {
 			t.Errorf("Expected %q but got %q", expected, result)
 		}
 	})
+
+	t.Run("missing Content-Type is plain text", func(t *testing.T) {
+		email := createTestEmail("Subject: No type\r\n\r\nWin a prize now")
+
+		result, err := CleanEmailBody(email)
+		if err != nil {
+			t.Fatalf("CleanEmailBody returned error: %v", err)
+		}
+		expected := "Win a prize now"
+		if result != expected {
+			t.Errorf("Expected %q but got %q", expected, result)
+		}
+	})
+
+	t.Run("unknown single-part type", func(t *testing.T) {
+		email := createEmail("application/x-unknown", []byte("Readable content"))
+
+		result, err := CleanEmailBody(email)
+		if err != nil {
+			t.Fatalf("CleanEmailBody returned error: %v", err)
+		}
+		expected := "Readable content"
+		if result != expected {
+			t.Errorf("Expected %q but got %q", expected, result)
+		}
+	})
+
+	t.Run("binary single-part type", func(t *testing.T) {
+		email := createEmail("application/octet-stream", []byte("\x00\xff\xfebinary"))
+
+		result, err := CleanEmailBody(email)
+		if err != nil {
+			t.Fatalf("CleanEmailBody returned error: %v", err)
+		}
+		if result != "" {
+			t.Errorf("Expected binary body to be skipped, got %q", result)
+		}
+	})
 }
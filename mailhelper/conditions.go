@@ -0,0 +1,68 @@
+package mailhelper
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Condition forces the score of the messages having a matching signal,
+// without asking the LLM. Signals are matched as path.Match patterns, so
+// "attachment:*" matches any flagged attachment.
+type Condition struct {
+	Signal string  `yaml:"signal"`
+	Score  float64 `yaml:"score"`
+}
+
+// Validate checks the signal pattern.
+func (c Condition) Validate() error {
+	if _, err := path.Match(c.Signal, ""); err != nil || c.Signal == "" {
+		return fmt.Errorf("invalid signal pattern %q", c.Signal)
+	}
+	return nil
+}
+
+// MatchCondition returns the first condition matching one of the signals and
+// the matched signal.
+func MatchCondition(conditions []Condition, signals []string) (Condition, string, bool) {
+	for _, condition := range conditions {
+		for _, signal := range signals {
+			if ok, _ := path.Match(condition.Signal, signal); ok {
+				return condition, signal, true
+			}
+		}
+	}
+	return Condition{}, "", false
+}
+
+// flagSignals converts flags to signals under prefix, e.g. "link:text_mismatch".
+func flagSignals(prefix string, flags []string) []string {
+	signals := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		signals = append(signals, prefix+":"+strings.ToLower(flag))
+	}
+	return signals
+}
+
+// Signals returns the signals raised by the links, the attachments and the
+// MIME structure.
+func (c *EmailContent) Signals() []string {
+	seen := map[string]bool{}
+	var signals []string
+	add := func(candidates []string) {
+		for _, signal := range candidates {
+			if !seen[signal] {
+				seen[signal] = true
+				signals = append(signals, signal)
+			}
+		}
+	}
+	for _, link := range c.Links {
+		add(flagSignals("link", link.Flags))
+	}
+	for _, attachment := range c.Attachments {
+		add(flagSignals("attachment", attachment.Flags))
+	}
+	add(flagSignals("mime", c.MIMEFlags))
+	return signals
+}
@@ -0,0 +1,42 @@
+package mailhelper
+
+import "testing"
+
+func TestMatchCondition(t *testing.T) {
+	conditions := []Condition{
+		{Signal: "attachment:executable", Score: 10},
+		{Signal: "link:*", Score: 8},
+	}
+	tests := []struct {
+		name    string
+		signals []string
+		score   float64
+		signal  string
+		ok      bool
+	}{
+		{name: "no signals", signals: nil},
+		{name: "exact match", signals: []string{"attachment:executable"}, score: 10, signal: "attachment:executable", ok: true},
+		{name: "glob match", signals: []string{"attachment:macro_enabled", "link:punycode"}, score: 8, signal: "link:punycode", ok: true},
+		{name: "first condition wins", signals: []string{"link:redirect", "attachment:executable"}, score: 10, signal: "attachment:executable", ok: true},
+		{name: "no match", signals: []string{"attachment:macro_enabled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, signal, ok := MatchCondition(conditions, tt.signals)
+			if ok != tt.ok || signal != tt.signal || condition.Score != tt.score {
+				t.Errorf("MatchCondition() = %+v, %q, %v", condition, signal, ok)
+			}
+		})
+	}
+}
+
+func TestConditionValidate(t *testing.T) {
+	if err := (Condition{Signal: "link:*"}).Validate(); err != nil {
+		t.Errorf("Validate returned error: %v", err)
+	}
+	for _, signal := range []string{"", "link:[", "attachment:\\"} {
+		if err := (Condition{Signal: signal}).Validate(); err == nil {
+			t.Errorf("Expected error for signal %q", signal)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package mailhelper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// MailboxScan is how far a Sent mailbox has been scanned.
+type MailboxScan struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	LastUID     uint32 `json:"last_uid"`
+}
+
+// ContactBook is the persisted set of addresses we have written to, used to
+// whitelist them automatically. Contacts not mailed in ExpireMonths are
+// forgotten.
+type ContactBook struct {
+	Contacts     map[string]time.Time   `json:"contacts"`
+	Mailboxes    map[string]MailboxScan `json:"mailboxes"`
+	Filename     string                 `json:"-"`
+	ExpireMonths int                    `json:"-"`
+	mu           sync.Mutex
+}
+
+// NewContactBook loads the contact book stored in filename. A missing file is
+// not an error and results in an empty book.
+func NewContactBook(filename string, expireMonths int) (*ContactBook, error) {
+	book := &ContactBook{
+		Contacts:     map[string]time.Time{},
+		Mailboxes:    map[string]MailboxScan{},
+		Filename:     filename,
+		ExpireMonths: expireMonths,
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return book, nil
+	}
+	if err != nil {
+		return book, err
+	}
+	if err := json.Unmarshal(data, book); err != nil {
+		return book, fmt.Errorf("error parsing contact book %s: %v", filename, err)
+	}
+	if book.Contacts == nil {
+		book.Contacts = map[string]time.Time{}
+	}
+	if book.Mailboxes == nil {
+		book.Mailboxes = map[string]MailboxScan{}
+	}
+	return book, nil
+}
+
+// expired returns true if a contact last mailed at sent is too old at now.
+func (b *ContactBook) expired(sent time.Time, now time.Time) bool {
+	return b.ExpireMonths > 0 && sent.Before(now.AddDate(0, -b.ExpireMonths, 0))
+}
+
+// Add records that we mailed address at sent. It returns true for new
+// contacts.
+func (b *ContactBook) Add(address string, sent time.Time) bool {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if strings.Count(address, "@") != 1 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	last, ok := b.Contacts[address]
+	if !ok || sent.After(last) {
+		b.Contacts[address] = sent
+	}
+	return !ok
+}
+
+// Contains returns true if we mailed address recently enough at now.
+func (b *ContactBook) Contains(address string, now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sent, ok := b.Contacts[strings.ToLower(address)]
+	return ok && !b.expired(sent, now)
+}
+
+// Expire forgets the contacts not mailed in ExpireMonths and returns how many
+// were removed.
+func (b *ContactBook) Expire(now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	removed := 0
+	for address, sent := range b.Contacts {
+		if b.expired(sent, now) {
+			delete(b.Contacts, address)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Save writes the contact book to its file.
+func (b *ContactBook) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.Filename, data, 0644)
+}
+
+// addRecipients adds the To, Cc and Bcc recipients of a sent message, dated
+// by its envelope or its internal date.
+func (b *ContactBook) addRecipients(msg *imap.Message) int {
+	if msg.Envelope == nil {
+		return 0
+	}
+	sent := msg.Envelope.Date
+	if sent.IsZero() {
+		sent = msg.InternalDate
+	}
+	added := 0
+	for _, list := range [][]*imap.Address{msg.Envelope.To, msg.Envelope.Cc, msg.Envelope.Bcc} {
+		for _, address := range list {
+			// Group syntax markers have no host name.
+			if address.MailboxName == "" || address.HostName == "" {
+				continue
+			}
+			if b.Add(address.Address(), sent) {
+				added++
+			}
+		}
+	}
+	return added
+}
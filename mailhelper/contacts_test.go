@@ -0,0 +1,58 @@
+package mailhelper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestContactBook(t *testing.T) {
+	path := t.TempDir() + "/contacts.json"
+	book, err := NewContactBook(path, 6)
+	if err != nil {
+		t.Fatalf("NewContactBook returned error: %v", err)
+	}
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	msg := &imap.Message{
+		Uid: 7,
+		Envelope: &imap.Envelope{
+			Date: now.AddDate(0, -1, 0),
+			To:   []*imap.Address{{PersonalName: "Jane", MailboxName: "Jane", HostName: "Example.com"}},
+			Cc:   []*imap.Address{{MailboxName: "undisclosed-recipients"}, {MailboxName: "bob", HostName: "example.org"}},
+		},
+	}
+	if added := book.addRecipients(msg); added != 2 {
+		t.Errorf("Expected 2 new contacts, got %d", added)
+	}
+	if book.Add("bob@example.org", now.AddDate(-1, 0, 0)) {
+		t.Error("Expected bob@example.org to be known")
+	}
+	book.Add("old@example.net", now.AddDate(0, -7, 0))
+	book.Mailboxes["Sent"] = MailboxScan{UIDValidity: 1, LastUID: 7}
+
+	if !book.Contains("jane@example.com", now) || !book.Contains("Bob@Example.org", now) {
+		t.Error("Expected recent contacts to be whitelisted")
+	}
+	if book.Contains("old@example.net", now) {
+		t.Error("Expected old contact to be expired")
+	}
+	if removed := book.Expire(now); removed != 1 {
+		t.Errorf("Expected 1 expired contact, got %d", removed)
+	}
+	if err := book.Save(); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	loaded, err := NewContactBook(path, 6)
+	if err != nil {
+		t.Fatalf("NewContactBook returned error: %v", err)
+	}
+	if len(loaded.Contacts) != 2 || !loaded.Contains("bob@example.org", now) {
+		t.Errorf("Unexpected contacts after reload: %v", loaded.Contacts)
+	}
+	if loaded.Mailboxes["Sent"].LastUID != 7 {
+		t.Errorf("Expected the scan state to be persisted, got %+v", loaded.Mailboxes)
+	}
+}
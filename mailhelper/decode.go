@@ -0,0 +1,67 @@
+package mailhelper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// headerGetter is implemented by both mail.Header and textproto.MIMEHeader.
+type headerGetter interface {
+	Get(key string) string
+}
+
+// decodeTransferEncoding wraps body with a decoder for the given
+// Content-Transfer-Encoding. 7bit, 8bit, binary and unknown encodings are
+// returned as is.
+func decodeTransferEncoding(body io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// decodeCharset converts data from the given charset to UTF-8. When the
+// charset is not declared, HTML is sniffed from its meta tags and anything
+// else is assumed to be UTF-8 already.
+func decodeCharset(data []byte, label string, mediaType string) ([]byte, error) {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		if mediaType != "text/html" {
+			return data, nil
+		}
+		_, label, _ = charset.DetermineEncoding(data, mediaType)
+	}
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		// Unknown charsets are passed through rather than dropping the text.
+		return data, nil
+	}
+	if name, _ := htmlindex.Name(enc); name == "utf-8" {
+		return data, nil
+	}
+	decoded, err := io.ReadAll(enc.NewDecoder().Reader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding charset %s: %v", label, err)
+	}
+	return decoded, nil
+}
+
+// readText reads a text entity decoding its transfer encoding and charset.
+func readText(header headerGetter, body io.Reader, mediaType string, params map[string]string) ([]byte, error) {
+	data, err := io.ReadAll(decodeTransferEncoding(body, header.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s body: %v", mediaType, err)
+	}
+	return decodeCharset(data, params["charset"], mediaType)
+}
@@ -0,0 +1,68 @@
+package mailhelper
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTransferEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     string
+		want     string
+	}{
+		{name: "base64", encoding: "base64", body: "R3LDvMOfZSBh\r\ndXMgTcO8bmNoZW4=", want: "Grüße aus München"},
+		{name: "quoted-printable", encoding: "Quoted-Printable", body: "Caf=C3=A9 =\r\nsoft break", want: "Café soft break"},
+		{name: "7bit", encoding: "7bit", body: "plain", want: "plain"},
+		{name: "no encoding", encoding: "", body: "plain", want: "plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(decodeTransferEncoding(strings.NewReader(tt.body), tt.encoding))
+			if err != nil {
+				t.Fatalf("decodeTransferEncoding returned error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, string(got))
+			}
+		})
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		charset   string
+		mediaType string
+		want      string
+	}{
+		{name: "utf-8", data: []byte("Grüße"), charset: "utf-8", mediaType: "text/plain", want: "Grüße"},
+		{name: "undeclared plain text", data: []byte("Grüße"), charset: "", mediaType: "text/plain", want: "Grüße"},
+		{name: "iso-8859-1", data: []byte("Caf\xe9 \xe0 la cr\xe8me"), charset: "ISO-8859-1", mediaType: "text/plain", want: "Café à la crème"},
+		{name: "windows-1252", data: []byte("\x93Free\x94 \x80100"), charset: "windows-1252", mediaType: "text/plain", want: "“Free” €100"},
+		{name: "shift-jis", data: []byte("\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd"), charset: "Shift_JIS", mediaType: "text/plain", want: "こんにちは"},
+		{name: "gb2312", data: []byte("\xc4\xe3\xba\xc3\xca\xc0\xbd\xe7"), charset: "gb2312", mediaType: "text/plain", want: "你好世界"},
+		{
+			name:      "html meta charset",
+			data:      []byte(`<html><head><meta charset="iso-8859-1"></head><body>Caf` + "\xe9" + `</body></html>`),
+			charset:   "",
+			mediaType: "text/html",
+			want:      `<html><head><meta charset="iso-8859-1"></head><body>Café</body></html>`,
+		},
+		{name: "unknown charset", data: []byte("text"), charset: "x-unknown", mediaType: "text/plain", want: "text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeCharset(tt.data, tt.charset, tt.mediaType)
+			if err != nil {
+				t.Fatalf("decodeCharset returned error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, string(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package mailhelper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const (
+	// maxDKIMVerifications caps the signatures verified per message, as each
+	// one needs a DNS lookup.
+	maxDKIMVerifications = 5
+	// dkimLookupTimeout bounds every DNS lookup of a DKIM key.
+	dkimLookupTimeout = 5 * time.Second
+)
+
+// TXTResolver looks up DNS TXT records. *net.Resolver implements it, tests and
+// air-gapped hosts can provide their own.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DKIMResult is the outcome of verifying the DKIM signatures of a message.
+type DKIMResult struct {
+	// Domains are the signing domains of the valid signatures.
+	Domains []string
+	// Signatures is the number of signatures checked.
+	Signatures int
+}
+
+// Result returns pass if a signature is valid, fail if none is and none if the
+// message is not signed.
+func (r DKIMResult) Result() string {
+	switch {
+	case len(r.Domains) > 0:
+		return "pass"
+	case r.Signatures > 0:
+		return "fail"
+	}
+	return "none"
+}
+
+// String formats the result for the LLM prompt.
+func (r DKIMResult) String() string {
+	s := "local DKIM verification: " + r.Result()
+	if len(r.Domains) > 0 {
+		s += " (valid signatures from " + strings.Join(r.Domains, ", ") + ")"
+	}
+	return s
+}
+
+// Signal returns the signal of the result, e.g. "auth:local_dkim=fail".
+func (r DKIMResult) Signal() string {
+	return "auth:local_dkim=" + r.Result()
+}
+
+// VerifyDKIM verifies the DKIM signatures of the raw message, fetching the
+// public keys with resolver.
+func VerifyDKIM(raw []byte, resolver TXTResolver) (DKIMResult, error) {
+	var result DKIMResult
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), dkimLookupTimeout)
+			defer cancel()
+			return resolver.LookupTXT(ctx, domain)
+		},
+		MaxVerifications: maxDKIMVerifications,
+	})
+	// The first signatures are still verified when there are too many.
+	if err != nil && !errors.Is(err, dkim.ErrTooManySignatures) {
+		return result, err
+	}
+	result.Signatures = len(verifications)
+	for _, verification := range verifications {
+		if verification.Err == nil {
+			result.Domains = append(result.Domains, strings.ToLower(verification.Domain))
+		}
+	}
+	return result, nil
+}
+
+// VerifyDKIM verifies the DKIM signatures of the email.
+func (m *Email) VerifyDKIM(resolver TXTResolver) (DKIMResult, error) {
+	return VerifyDKIM(m.GetRawEmail(), resolver)
+}
@@ -0,0 +1,92 @@
+package mailhelper
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// fakeTXTResolver serves TXT records from a map.
+type fakeTXTResolver map[string]string
+
+func (f fakeTXTResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	record, ok := f[name]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", name)
+	}
+	return []string{record}, nil
+}
+
+// signEmail signs raw with a new key for domain and returns the signed
+// message and a resolver publishing the key.
+func signEmail(t *testing.T, raw string, domain string) (string, fakeTXTResolver) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey returned error: %v", err)
+	}
+	var signed bytes.Buffer
+	err = dkim.Sign(&signed, strings.NewReader(raw), &dkim.SignOptions{
+		Domain:   domain,
+		Selector: "test",
+		Signer:   privateKey,
+	})
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+	resolver := fakeTXTResolver{
+		"test._domainkey." + domain: "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(publicKey),
+	}
+	return signed.String(), resolver
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	raw := "From: support@bank.com\r\n" +
+		"Subject: Statement\r\n" +
+		"\r\n" +
+		"Your statement is ready\r\n"
+	signed, resolver := signEmail(t, raw, "bank.com")
+
+	result, err := VerifyDKIM([]byte(signed), resolver)
+	if err != nil {
+		t.Fatalf("VerifyDKIM returned error: %v", err)
+	}
+	if result.Result() != "pass" || len(result.Domains) != 1 || result.Domains[0] != "bank.com" {
+		t.Errorf("Expected a valid signature from bank.com, got %+v", result)
+	}
+	if s := result.String(); s != "local DKIM verification: pass (valid signatures from bank.com)" {
+		t.Errorf("Unexpected string %q", s)
+	}
+
+	tampered := strings.Replace(signed, "Your statement", "Your invoice", 1)
+	result, err = VerifyDKIM([]byte(tampered), resolver)
+	if err != nil {
+		t.Fatalf("VerifyDKIM returned error: %v", err)
+	}
+	if result.Result() != "fail" || result.Signal() != "auth:local_dkim=fail" {
+		t.Errorf("Expected the tampered message to fail, got %+v", result)
+	}
+
+	result, err = VerifyDKIM([]byte(signed), fakeTXTResolver{})
+	if err != nil {
+		t.Fatalf("VerifyDKIM returned error: %v", err)
+	}
+	if result.Result() != "fail" {
+		t.Errorf("Expected a missing key to fail, got %+v", result)
+	}
+
+	result, err = VerifyDKIM([]byte(raw), resolver)
+	if err != nil {
+		t.Fatalf("VerifyDKIM returned error: %v", err)
+	}
+	if result.Result() != "none" {
+		t.Errorf("Expected an unsigned message, got %+v", result)
+	}
+}
@@ -0,0 +1,203 @@
+package mailhelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDNSBLDomains caps the link domains looked up per message.
+	maxDNSBLDomains = 10
+	// dnsblTimeout bounds all the DNSBL lookups of a message, which run
+	// concurrently.
+	dnsblTimeout = 3 * time.Second
+)
+
+// HostResolver looks up the addresses of DNS names. *net.Resolver implements
+// it, tests and air-gapped hosts (e.g. with a local rbldnsd) can provide their
+// own.
+type HostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNSBLHit is a listing of an IP address or domain in a DNS blocklist.
+type DNSBLHit struct {
+	// Name is the listed IP address or domain.
+	Name string
+	Zone string
+	// Codes are the 127.0.0.x return codes, telling why it is listed.
+	Codes []string
+	// Domain is true for URIBL (domain) listings.
+	Domain bool
+}
+
+// String formats the hit for the LLM prompt.
+func (h DNSBLHit) String() string {
+	if h.Domain {
+		return fmt.Sprintf("URIBL: link domain %s is listed in %s (%s)", h.Name, h.Zone, strings.Join(h.Codes, ", "))
+	}
+	return fmt.Sprintf("DNSBL: origin IP %s is listed in %s (%s)", h.Name, h.Zone, strings.Join(h.Codes, ", "))
+}
+
+// Signal returns the signal of the hit, e.g. "dnsbl:zen.spamhaus.org" or
+// "uribl:dbl.spamhaus.org".
+func (h DNSBLHit) Signal() string {
+	if h.Domain {
+		return "uribl:" + strings.ToLower(h.Zone)
+	}
+	return "dnsbl:" + strings.ToLower(h.Zone)
+}
+
+// DNSBLChecker looks up IP addresses in DNSBL zones and domains in URIBL
+// zones.
+type DNSBLChecker struct {
+	resolver    HostResolver
+	ipZones     []string
+	domainZones []string
+}
+
+// NewDNSBLChecker checks IP addresses against ipZones and domains against
+// domainZones, e.g. zen.spamhaus.org and dbl.spamhaus.org, with resolver.
+func NewDNSBLChecker(resolver HostResolver, ipZones []string, domainZones []string) *DNSBLChecker {
+	return &DNSBLChecker{resolver: resolver, ipZones: trimZones(ipZones), domainZones: trimZones(domainZones)}
+}
+
+func trimZones(zones []string) []string {
+	var trimmed []string
+	for _, zone := range zones {
+		if zone = strings.Trim(strings.TrimSpace(zone), "."); zone != "" {
+			trimmed = append(trimmed, zone)
+		}
+	}
+	return trimmed
+}
+
+// reverseIP returns the DNSBL query label of ip: the reversed octets of IPv4
+// addresses and the reversed nibbles of IPv6 addresses.
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip16[i]&0xf), fmt.Sprintf("%x", ip16[i]>>4))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// lookup queries name and returns the listing codes. Unlisted names do not
+// resolve; answers outside of 127.0.0.0/8 and the 127.255.255.x error codes
+// (e.g. queries refused through public resolvers) are not listings.
+func (c *DNSBLChecker) lookup(ctx context.Context, name string) ([]string, error) {
+	addresses, err := c.resolver.LookupHost(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var codes []string
+	for _, address := range addresses {
+		ip := net.ParseIP(address).To4()
+		if ip == nil || ip[0] != 127 || (ip[1] == 255 && ip[2] == 255) {
+			continue
+		}
+		codes = append(codes, ip.String())
+	}
+	return codes, nil
+}
+
+// lookupAll queries all the names concurrently until deadline and returns
+// their listing codes, in the order of names.
+func (c *DNSBLChecker) lookupAll(names []string, deadline time.Time) ([][]string, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	codes := make([][]string, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i], errs[i] = c.lookup(ctx, name)
+		}()
+	}
+	wg.Wait()
+	return codes, errors.Join(errs...)
+}
+
+// CheckIP looks up ip in the DNSBL zones until deadline. Lookup errors are
+// returned with the hits found in the other zones.
+func (c *DNSBLChecker) CheckIP(ip net.IP, deadline time.Time) ([]DNSBLHit, error) {
+	if c == nil || ip == nil {
+		return nil, nil
+	}
+	names := make([]string, 0, len(c.ipZones))
+	for _, zone := range c.ipZones {
+		names = append(names, reverseIP(ip)+"."+zone)
+	}
+	codes, err := c.lookupAll(names, deadline)
+	var hits []DNSBLHit
+	for i, zone := range c.ipZones {
+		if len(codes[i]) > 0 {
+			hits = append(hits, DNSBLHit{Name: ip.String(), Zone: zone, Codes: codes[i]})
+		}
+	}
+	return hits, err
+}
+
+// CheckDomains looks up the registrable domains of domains, up to
+// maxDNSBLDomains of them, in the URIBL zones until deadline.
+func (c *DNSBLChecker) CheckDomains(domains []string, deadline time.Time) ([]DNSBLHit, error) {
+	if c == nil || len(c.domainZones) == 0 {
+		return nil, nil
+	}
+	var sites []string
+	seen := map[string]bool{}
+	for _, domain := range domains {
+		site := registrableDomain(NormalizeDomain(domain))
+		if site == "" || seen[site] || net.ParseIP(site) != nil {
+			continue
+		}
+		if len(sites) == maxDNSBLDomains {
+			break
+		}
+		seen[site] = true
+		sites = append(sites, site)
+	}
+	var names []string
+	for _, site := range sites {
+		for _, zone := range c.domainZones {
+			names = append(names, site+"."+zone)
+		}
+	}
+	codes, err := c.lookupAll(names, deadline)
+	var hits []DNSBLHit
+	for i, site := range sites {
+		for j, zone := range c.domainZones {
+			if found := codes[i*len(c.domainZones)+j]; len(found) > 0 {
+				hits = append(hits, DNSBLHit{Name: site, Zone: zone, Codes: found, Domain: true})
+			}
+		}
+	}
+	return hits, err
+}
+
+// linkDomains returns the host names of the destinations of links.
+func linkDomains(links []Link) []string {
+	var domains []string
+	for _, link := range links {
+		if u, err := url.Parse(link.Destination); err == nil && u.Hostname() != "" {
+			domains = append(domains, u.Hostname())
+		}
+	}
+	return domains
+}
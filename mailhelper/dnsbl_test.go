@@ -0,0 +1,113 @@
+package mailhelper
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeHostResolver serves A records from a map, as a local rbldnsd would.
+type fakeHostResolver map[string][]string
+
+func (f fakeHostResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addresses, ok := f[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addresses, nil
+}
+
+func TestReverseIP(t *testing.T) {
+	if got := reverseIP(net.ParseIP("198.51.100.7")); got != "7.100.51.198" {
+		t.Errorf("reverseIP() = %q", got)
+	}
+	want := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"
+	if got := reverseIP(net.ParseIP("2001:db8::1")); got != want {
+		t.Errorf("reverseIP() = %q, want %q", got, want)
+	}
+}
+
+func TestDNSBLCheckIP(t *testing.T) {
+	resolver := fakeHostResolver{
+		"7.100.51.198.zen.example":   {"127.0.0.2", "127.0.0.11"},
+		"7.100.51.198.bl.example":    {"127.255.255.254"},
+		"7.100.51.198.other.example": {"192.0.2.1"},
+	}
+	checker := NewDNSBLChecker(resolver, []string{"zen.example", " bl.example.", "other.example", "none.example"}, nil)
+	hits, err := checker.CheckIP(net.ParseIP("198.51.100.7"), time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("CheckIP returned error: %v", err)
+	}
+	want := []DNSBLHit{{Name: "198.51.100.7", Zone: "zen.example", Codes: []string{"127.0.0.2", "127.0.0.11"}}}
+	if !reflect.DeepEqual(hits, want) {
+		t.Fatalf("CheckIP() = %+v, want %+v", hits, want)
+	}
+	if hits[0].String() != "DNSBL: origin IP 198.51.100.7 is listed in zen.example (127.0.0.2, 127.0.0.11)" {
+		t.Errorf("Unexpected string %q", hits[0].String())
+	}
+	if hits[0].Signal() != "dnsbl:zen.example" {
+		t.Errorf("Unexpected signal %q", hits[0].Signal())
+	}
+
+	hits, err = checker.CheckIP(net.ParseIP("192.0.2.1"), time.Now().Add(time.Second))
+	if err != nil || len(hits) != 0 {
+		t.Errorf("Expected no hits, got %+v, %v", hits, err)
+	}
+	var nilChecker *DNSBLChecker
+	if hits, err := nilChecker.CheckIP(net.ParseIP("198.51.100.7"), time.Now().Add(time.Second)); hits != nil || err != nil {
+		t.Errorf("Expected a nil checker to check nothing")
+	}
+}
+
+type failingHostResolver struct{}
+
+func (failingHostResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestDNSBLCheckIPError(t *testing.T) {
+	checker := NewDNSBLChecker(failingHostResolver{}, []string{"zen.example"}, nil)
+	if _, err := checker.CheckIP(net.ParseIP("198.51.100.7"), time.Now().Add(time.Second)); err == nil {
+		t.Error("Expected the lookup error")
+	}
+}
+
+func TestDNSBLCheckDomains(t *testing.T) {
+	resolver := fakeHostResolver{
+		"evil.example.dbl.example": {"127.0.1.2"},
+	}
+	checker := NewDNSBLChecker(resolver, nil, []string{"dbl.example"})
+	hits, err := checker.CheckDomains([]string{"www.evil.example", "EVIL.example", "good.example", "192.0.2.1"}, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("CheckDomains returned error: %v", err)
+	}
+	want := []DNSBLHit{{Name: "evil.example", Zone: "dbl.example", Codes: []string{"127.0.1.2"}, Domain: true}}
+	if !reflect.DeepEqual(hits, want) {
+		t.Fatalf("CheckDomains() = %+v, want %+v", hits, want)
+	}
+	if hits[0].String() != "URIBL: link domain evil.example is listed in dbl.example (127.0.1.2)" || hits[0].Signal() != "uribl:dbl.example" {
+		t.Errorf("Unexpected hit %q, %q", hits[0].String(), hits[0].Signal())
+	}
+}
+
+// stalledHostResolver never answers, like an unreachable DNS server.
+type stalledHostResolver struct{}
+
+func (stalledHostResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestDNSBLSharedDeadline(t *testing.T) {
+	checker := NewDNSBLChecker(stalledHostResolver{}, []string{"a.example", "b.example", "c.example", "d.example"}, nil)
+	start := time.Now()
+	if _, err := checker.CheckIP(net.ParseIP("198.51.100.7"), start.Add(100*time.Millisecond)); err == nil {
+		t.Error("Expected the timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Expected the lookups to share the deadline, took %v", elapsed)
+	}
+}
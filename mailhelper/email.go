@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"github.com/emersion/go-imap"
 	"io"
+	"mime"
 	"net/mail"
+	"net/textproto"
 	"os"
-	"regexp"
-	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 type Email struct {
@@ -47,10 +50,48 @@ func (m *Email) GetHeader(header string) string {
 	return m.msg.Header.Get(header)
 }
 
+// wordDecoder decodes RFC 2047 encoded words in any charset known to x/text,
+// not only the UTF-8 and ISO-8859-1 supported by the standard library.
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q: %v", label, err)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// decodeHeader decodes the RFC 2047 encoded words of a header value. The raw
+// value is returned if it cannot be decoded.
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// GetDecodedHeader returns the value of header with RFC 2047 encoded words
+// decoded, for headers shown to humans and to the LLM.
+func (m *Email) GetDecodedHeader(header string) string {
+	return decodeHeader(m.msg.Header.Get(header))
+}
+
+// GetAddressList parses an address header decoding the display names.
+func (m *Email) GetAddressList(header string) ([]*mail.Address, error) {
+	value := m.msg.Header.Get(header)
+	if value == "" {
+		return nil, mail.ErrHeaderNotPresent
+	}
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	return parser.ParseList(value)
+}
+
 func (m *Email) GetSender() (*mail.Address, error) {
-	sender, err := m.msg.Header.AddressList("Sender")
+	sender, err := m.GetAddressList("Sender")
 	if err != nil {
-		sender, err := m.msg.Header.AddressList("From")
+		sender, err := m.GetAddressList("From")
 		if err != nil {
 			return nil, err
 		}
@@ -60,12 +101,48 @@ func (m *Email) GetSender() (*mail.Address, error) {
 }
 
 func (m *Email) GetSubject() string {
-	return m.msg.Header.Get("Subject")
+	return m.GetDecodedHeader("Subject")
 }
 func (m *Email) GetRawEmail() []byte {
 	return m.rawMsg
 }
 
+// headerField is a header of the message, in the order it was written.
+type headerField struct {
+	name  string
+	value string
+}
+
+// headerFields returns the headers of the raw message in order, with their
+// names canonicalized and their folded lines joined as mail.Header does. The
+// order matters for headers added by several servers, which mail.Header
+// loses across names.
+func (m *Email) headerFields() []headerField {
+	var fields []headerField
+	for _, line := range strings.Split(string(m.rawMsg), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(fields) > 0 {
+				last := &fields[len(fields)-1]
+				last.value = strings.TrimSpace(last.value + " " + strings.TrimSpace(line))
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, headerField{
+			name:  textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)),
+			value: strings.TrimSpace(value),
+		})
+	}
+	return fields
+}
+
 func (m *Email) GetBody() ([]byte, error) {
 	body, err := io.ReadAll(m.msg.Body)
 	if err != nil {
@@ -74,20 +151,11 @@ func (m *Email) GetBody() ([]byte, error) {
 	return body, nil
 }
 
+// ExtractSpamStatus returns the SpamAssassin score of the X-Spam-Status
+// header (hits= or score=), or 0 if there is none.
 func ExtractSpamStatus(email *Email) (float64, error) {
-	value := email.GetHeader("X-Spam-Status")
-	re := regexp.MustCompile(`hits=(\-?[\d\.]+)`)
-	matches := re.FindStringSubmatch(value)
-	if len(matches) >= 2 {
-		// Parse the captured string as a float64.
-		hits, err := strconv.ParseFloat(matches[1], 64)
-		if err != nil {
-			return 0, fmt.Errorf("error parsing float: %v", err)
-		}
-		return hits, nil
-	}
-	return 0, nil
-
+	verdict, _, err := parseSpamAssassin(email.GetHeaders())
+	return verdict.Score, err
 }
 
 type LastProcessed struct {
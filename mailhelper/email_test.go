@@ -116,6 +116,41 @@ func TestGetSubject(t *testing.T) {
 	}
 }
 
+func TestDecodedHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		want    string
+	}{
+		{name: "plain subject", subject: "Hello", want: "Hello"},
+		{name: "utf-8 base64", subject: "=?UTF-8?B?w5xuw69jw7Zkw6kgU3ViamVjdA==?=", want: "Ünïcödé Subject"},
+		{name: "iso-8859-1 quoted-printable", subject: "=?ISO-8859-1?Q?Caf=E9?= =?ISO-8859-1?Q?_gratuit?=", want: "Café gratuit"},
+		{name: "shift-jis", subject: "=?Shift_JIS?B?k/qWe4zqgsyMj5a8?=", want: "日本語の件名"},
+		{name: "mixed encoded and plain words", subject: "Re: =?UTF-8?Q?=E2=82=AC100?= prize", want: "Re: €100 prize"},
+		{name: "invalid encoded word is kept", subject: "=?x-unknown?Q?abc?=", want: "=?x-unknown?Q?abc?="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := createTestEmail("Subject: " + tt.subject + "\r\n\r\nBody")
+			if got := email.GetSubject(); got != tt.want {
+				t.Errorf("Expected subject %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	email := createTestEmail("From: =?Shift_JIS?B?k/qWe4zqgsyMj5a8?= <jp@example.com>\r\n\r\nBody")
+	sender, err := email.GetSender()
+	if err != nil {
+		t.Fatalf("GetSender returned error: %v", err)
+	}
+	if sender.Name != "日本語の件名" || sender.Address != "jp@example.com" {
+		t.Errorf("Unexpected sender %+v", sender)
+	}
+	if got := formatAddress(sender); got != "日本語の件名 <jp@example.com>" {
+		t.Errorf("Unexpected formatted sender %q", got)
+	}
+}
+
 func TestGetRawEmail(t *testing.T) {
 	raw := "Subject: Raw Test\r\n\r\nBody content"
 	email := createTestEmail(raw)
@@ -0,0 +1,211 @@
+package mailhelper
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// maxExtractedText caps the text extracted from a single attachment, before
+// any token budget is applied.
+const maxExtractedText = 1 << 20
+
+// extractAttachmentText returns the text of PDF, DOCX and HTML attachments.
+// It returns false for other formats or if nothing could be extracted.
+func extractAttachmentText(filename string, sniffedType string, data []byte) (string, bool) {
+	ext := strings.ToLower(path.Ext(filename))
+	var text string
+	switch {
+	case sniffedType == "application/pdf":
+		text = extractPDFText(data)
+	case sniffedType == "application/zip" && ext == ".docx":
+		text = extractDOCXText(data)
+	case sniffedType == "text/html" || ext == ".html" || ext == ".htm":
+		doc, err := html.Parse(bytes.NewReader(data))
+		if err != nil {
+			return "", false
+		}
+		text = extractText(doc)
+	default:
+		return "", false
+	}
+	text = strings.TrimSpace(text)
+	if len(text) > maxExtractedText {
+		text = strings.ToValidUTF8(text[:maxExtractedText], "")
+	}
+	return text, text != ""
+}
+
+// maxPDFDictionary caps how far before its data the dictionary of a stream
+// is looked for.
+const maxPDFDictionary = 4096
+
+var (
+	// pdfStreamRe matches the end of a stream dictionary and the stream
+	// keyword. The dictionary is looked for backwards, within its object.
+	pdfStreamRe = regexp.MustCompile(`>>\s*stream\r?\n`)
+	// pdfTextRe matches the operands of the Tj, ' and " (literal strings) and
+	// TJ (arrays of strings) text showing operators.
+	pdfTextRe = regexp.MustCompile(`(?s)(\((?:\\.|[^\\)])*\))\s*(?:Tj|'|")|\[((?:\\.|[^\]])*)\]\s*TJ`)
+	// pdfArrayItemRe matches the strings and kerning numbers of a TJ array.
+	pdfArrayItemRe = regexp.MustCompile(`\((?:\\.|[^\\)])*\)|-?[\d.]+`)
+)
+
+// extractPDFText is a minimal pure Go PDF text extractor. It inflates the
+// Flate encoded content streams and collects the literal strings shown by the
+// text operators, which covers most generated PDFs. Fonts with custom
+// encodings and hex strings are not decoded.
+func extractPDFText(data []byte) string {
+	var builder strings.Builder
+	offset := 0
+	for {
+		loc := pdfStreamRe.FindIndex(data[offset:])
+		if loc == nil {
+			break
+		}
+		// The dictionary starts after the obj keyword of its object, never
+		// before the end of the previous stream.
+		dictStart := max(offset, offset+loc[0]-maxPDFDictionary)
+		dictEnd := offset + loc[0]
+		if i := bytes.LastIndex(data[dictStart:dictEnd], []byte("obj")); i >= 0 {
+			dictStart += i + len("obj")
+		}
+		dict := data[dictStart:dictEnd]
+		start := offset + loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[start : start+end]
+		offset = start + end + len("endstream")
+
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			r, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			// Truncated streams still yield the text inflated so far.
+			inflated, _ := io.ReadAll(io.LimitReader(r, maxExtractedText))
+			stream = inflated
+		} else if bytes.Contains(dict, []byte("/Filter")) {
+			// Other filters (images, fonts) do not hold text.
+			continue
+		}
+
+		for _, match := range pdfTextRe.FindAllSubmatch(stream, -1) {
+			if match[1] != nil {
+				builder.WriteString(decodePDFString(match[1]))
+			} else {
+				for _, item := range pdfArrayItemRe.FindAll(match[2], -1) {
+					if item[0] == '(' {
+						builder.WriteString(decodePDFString(item))
+					} else if kerning, err := strconv.ParseFloat(string(item), 64); err == nil && kerning < -200 {
+						// Big negative kerning is how many generators space words.
+						builder.WriteString(" ")
+					}
+				}
+			}
+			builder.WriteString(" ")
+		}
+		if builder.Len() > maxExtractedText {
+			break
+		}
+	}
+	return builder.String()
+}
+
+// decodePDFString decodes a PDF literal string including its parentheses.
+func decodePDFString(s []byte) string {
+	s = s[1 : len(s)-1]
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		// Bytes are PDFDocEncoding, which matches Latin-1 for text.
+		if s[i] != '\\' || i+1 == len(s) {
+			builder.WriteRune(rune(s[i]))
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			builder.WriteByte('\n')
+		case 'r':
+			builder.WriteByte('\r')
+		case 't':
+			builder.WriteByte('\t')
+		case 'b', 'f':
+		case '\r', '\n':
+			// Escaped end of line continues the string.
+		default:
+			if c >= '0' && c <= '7' {
+				// Up to three octal digits.
+				value := 0
+				j := i
+				for ; j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7'; j++ {
+					value = value*8 + int(s[j]-'0')
+				}
+				builder.WriteRune(rune(value))
+				i = j - 1
+			} else {
+				builder.WriteRune(rune(c))
+			}
+		}
+	}
+	return builder.String()
+}
+
+// extractDOCXText returns the text runs of word/document.xml, one line per
+// paragraph.
+func extractDOCXText(data []byte) string {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return ""
+	}
+	for _, f := range reader.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return ""
+		}
+		defer func() {
+			if err := rc.Close(); err != nil {
+				log.Printf("error closing %s: %v", f.Name, err)
+			}
+		}()
+
+		var builder strings.Builder
+		decoder := xml.NewDecoder(io.LimitReader(rc, 4*maxExtractedText))
+		inText := false
+		for {
+			token, err := decoder.Token()
+			if err != nil {
+				break
+			}
+			switch t := token.(type) {
+			case xml.StartElement:
+				inText = t.Name.Local == "t"
+			case xml.EndElement:
+				inText = false
+				if t.Name.Local == "p" {
+					builder.WriteString("\n")
+				}
+			case xml.CharData:
+				if inText {
+					builder.Write(t)
+				}
+			}
+		}
+		return builder.String()
+	}
+	return ""
+}
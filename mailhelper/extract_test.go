@@ -0,0 +1,159 @@
+package mailhelper
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// createPDF builds a minimal PDF whose page content stream is Flate encoded.
+func createPDF(t *testing.T, content string) []byte {
+	t.Helper()
+	var stream bytes.Buffer
+	w := zlib.NewWriter(&stream)
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatalf("Error compressing stream: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error closing zlib writer: %v", err)
+	}
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+	fmt.Fprintf(&pdf, "4 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", stream.Len())
+	pdf.Write(stream.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n")
+	pdf.WriteString("5 0 obj\n<< /Length 20 /Filter /DCTDecode >>\nstream\n(Image) Tj\nendstream\nendobj\n%%EOF\n")
+	return pdf.Bytes()
+}
+
+// createDOCX builds a minimal DOCX with one paragraph per text.
+func createDOCX(t *testing.T, paragraphs ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create("word/document.xml")
+	if err != nil {
+		t.Fatalf("Error creating document.xml: %v", err)
+	}
+	body := ""
+	for _, p := range paragraphs {
+		body += `<w:p><w:r><w:t>` + p + `</w:t></w:r></w:p>`
+	}
+	_, err = f.Write([]byte(`<?xml version="1.0"?><w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+		body + `</w:body></w:document>`))
+	if err != nil {
+		t.Fatalf("Error writing document.xml: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error closing zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractAttachmentText(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		want     string
+		ok       bool
+	}{
+		{
+			name:     "pdf",
+			filename: "invoice.pdf",
+			data:     createPDF(t, "BT /F1 12 Tf (Your account is \\(temporarily\\) locked) Tj ET BT [(Pay) -250 (now) ] TJ (Caf\\351) ' ET"),
+			want:     "Your account is (temporarily) locked Pay now Café",
+			ok:       true,
+		},
+		{
+			name:     "docx",
+			filename: "letter.docx",
+			data:     createDOCX(t, "Dear customer,", "Wire the funds today."),
+			want:     "Dear customer,\nWire the funds today.",
+			ok:       true,
+		},
+		{
+			name:     "html",
+			filename: "form.html",
+			data:     []byte("<html><body><h1>Login</h1><script>steal()</script></body></html>"),
+			want:     "Login",
+			ok:       true,
+		},
+		{
+			name:     "unsupported format",
+			filename: "image.png",
+			data:     []byte("\x89PNG\r\n\x1a\n"),
+			ok:       false,
+		},
+		{
+			name:     "corrupt docx",
+			filename: "broken.docx",
+			data:     []byte("PK\x03\x04broken"),
+			ok:       false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := extractAttachmentText(tt.filename, sniffContentType(tt.data), tt.data)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("extractAttachmentText() = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAppendAttachmentText(t *testing.T) {
+	count := func(s string) int { return len(s) / 4 }
+	attachments := []Attachment{
+		{Filename: "image.png"},
+		{Filename: "invoice.pdf", Text: "Your account is locked"},
+		{Filename: "long.docx", Text: strings.Repeat("filler ", 1000)},
+	}
+	got := appendAttachmentText("Body", attachments, 100, count)
+	if !strings.HasPrefix(got, "Body\n\n--- Text of attachment \"invoice.pdf\" ---\nYour account is locked") {
+		t.Errorf("Unexpected attachment text %q", got)
+	}
+	if !strings.Contains(got, "--- Text of attachment \"long.docx\" ---\n[NOTE:") {
+		t.Errorf("Expected long attachment to be truncated, got %q", got)
+	}
+	if strings.Contains(got, "image.png") {
+		t.Errorf("Expected attachments without text to be skipped, got %q", got)
+	}
+}
+
+func TestParseEmailContentWithText(t *testing.T) {
+	raw := "--b\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"See attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; name=\"form.html\"\r\n" +
+		"Content-Disposition: attachment; filename=\"form.html\"\r\n\r\n" +
+		"<p>Enter your password</p>\r\n" +
+		"--b--\r\n"
+	for _, tt := range []struct {
+		limit int64
+		want  string
+	}{{limit: 0, want: ""}, {limit: 10, want: ""}, {limit: 1024, want: "Enter your password"}} {
+		content, err := ParseEmailContentWithText(createEmail("multipart/mixed; boundary=b", []byte(raw)), tt.limit)
+		if err != nil {
+			t.Fatalf("ParseEmailContentWithText returned error: %v", err)
+		}
+		if len(content.Attachments) != 1 || content.Attachments[0].Text != tt.want {
+			t.Errorf("With limit %d expected attachment text %q, got %+v", tt.limit, tt.want, content.Attachments)
+		}
+	}
+}
+
+func TestExtractPDFTextStreamDictionaries(t *testing.T) {
+	// The dictionary of the catalog must not be taken for the one of the
+	// uncompressed content stream of the next object.
+	pdf := "%PDF-1.4\n1 0 obj\n<< /Type /Catalog /Filter /DCTDecode >>\nendobj\n" +
+		"2 0 obj\n<< /Length 12 >>\nstream\n(Hello) Tj\nendstream\nendobj\n" +
+		"3 0 obj\n<< /Length 12 /Filter /DCTDecode >>\nstream\n(Image) Tj\nendstream\nendobj\n%%EOF\n"
+	if got := strings.TrimSpace(extractPDFText([]byte(pdf))); got != "Hello" {
+		t.Errorf("Expected only the content stream text, got %q", got)
+	}
+}
@@ -0,0 +1,136 @@
+package mailhelper
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Header features derived from the headers of a message for the LLM prompt.
+const (
+	FeatureReplyTo   = "reply_to"
+	FeatureFirstHop  = "first_hop"
+	FeatureMessageID = "message_id"
+	FeatureBulk      = "bulk"
+	FeatureDateSkew  = "date_skew"
+	FeatureMailer    = "mailer"
+)
+
+// HeaderFeatures are all the available header features.
+var HeaderFeatures = []string{FeatureReplyTo, FeatureFirstHop, FeatureMessageID, FeatureBulk, FeatureDateSkew, FeatureMailer}
+
+// Signals raised by the header features.
+const (
+	SignalReplyToMismatch  = "header:reply_to_mismatch"
+	SignalMissingMessageID = "header:missing_message_id"
+	SignalBulk             = "header:bulk"
+	SignalDateSkew         = "header:date_skew"
+	SignalInvalidDate      = "header:invalid_date"
+)
+
+// maxDateSkew is how far the Date header can be from the time the message
+// was received.
+const maxDateSkew = 24 * time.Hour
+
+// ValidateHeaderFeatures checks the feature names.
+func ValidateHeaderFeatures(features []string) error {
+	for _, feature := range features {
+		known := false
+		for _, name := range HeaderFeatures {
+			known = known || feature == name
+		}
+		if !known {
+			return fmt.Errorf("unknown header feature %q, expected one of %s", feature, strings.Join(HeaderFeatures, ", "))
+		}
+	}
+	return nil
+}
+
+// addressDomain returns the normalized domain of an address.
+func addressDomain(address string) string {
+	return NormalizeDomain(address[strings.LastIndex(address, "@")+1:])
+}
+
+// ExtractHeaderFeatures derives the given features from the headers of the
+// email sent by sender, returning the prompt context lines and the signals
+// raised. trusted are our relays, skipped to find the first external hop. now
+// is used as the reception time when there is no Received header.
+func ExtractHeaderFeatures(email *Email, sender *mail.Address, features []string, trusted *TrustedRelays, now time.Time) ([]string, []string) {
+	var context, signals []string
+	headers := email.GetHeaders()
+	senderDomain := addressDomain(sender.Address)
+
+	for _, feature := range features {
+		switch feature {
+		case FeatureReplyTo:
+			replyTo, err := email.GetAddressList("Reply-To")
+			if err != nil {
+				continue
+			}
+			for _, address := range replyTo {
+				if !sameSite(addressDomain(address.Address), senderDomain) {
+					context = append(context, fmt.Sprintf("REPLY-TO: %s (a different domain from the sender)", formatAddress(address)))
+					signals = append(signals, SignalReplyToMismatch)
+					break
+				}
+			}
+		case FeatureFirstHop:
+			// The first hop sent from outside of our relays delivered the
+			// message to us.
+			if analysis := AnalyzeReceived(email.GetReceivedChain(), trusted); analysis.HasOrigin {
+				context = append(context, "FIRST EXTERNAL HOP: "+analysis.Origin.String())
+			}
+		case FeatureMessageID:
+			messageID := strings.Trim(strings.TrimSpace(headers.Get("Message-Id")), "<>")
+			_, domain, ok := strings.Cut(messageID, "@")
+			switch {
+			case messageID == "":
+				context = append(context, "MESSAGE-ID: missing")
+				signals = append(signals, SignalMissingMessageID)
+			case ok && !sameSite(NormalizeDomain(domain), senderDomain):
+				context = append(context, fmt.Sprintf("MESSAGE-ID: generated by %s, not the sender domain", domain))
+			}
+		case FeatureBulk:
+			var markers []string
+			for _, header := range []string{"List-Unsubscribe", "List-Id", "Feedback-Id", "X-Campaign", "X-Mailgun-Tag"} {
+				if headers.Get(header) != "" {
+					markers = append(markers, header)
+				}
+			}
+			if precedence := strings.ToLower(strings.TrimSpace(headers.Get("Precedence"))); precedence == "bulk" || precedence == "list" || precedence == "junk" {
+				markers = append(markers, "Precedence: "+precedence)
+			}
+			if len(markers) > 0 {
+				context = append(context, "BULK SENDER: "+strings.Join(markers, ", "))
+				signals = append(signals, SignalBulk)
+			}
+		case FeatureDateSkew:
+			received := now
+			if values := headers["Received"]; len(values) > 0 {
+				if hop, err := ParseReceived(values[0]); err == nil && !hop.Date.IsZero() {
+					received = hop.Date
+				}
+			}
+			date, err := headers.Date()
+			if err != nil {
+				context = append(context, "DATE: missing or invalid")
+				signals = append(signals, SignalInvalidDate)
+				continue
+			}
+			if skew := date.Sub(received); skew > maxDateSkew || skew < -maxDateSkew {
+				when := "after"
+				if skew < 0 {
+					skew, when = -skew, "before"
+				}
+				context = append(context, fmt.Sprintf("DATE: %s, %.1f days %s the reception time", date.Format(time.RFC1123Z), skew.Hours()/24, when))
+				signals = append(signals, SignalDateSkew)
+			}
+		case FeatureMailer:
+			if mailer := email.GetDecodedHeader("X-Mailer"); mailer != "" {
+				context = append(context, "X-MAILER: "+mailer)
+			}
+		}
+	}
+	return context, signals
+}
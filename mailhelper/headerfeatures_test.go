@@ -0,0 +1,111 @@
+package mailhelper
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtractHeaderFeatures(t *testing.T) {
+	raw := "Received: from mail.evil.example (mail.evil.example [192.0.2.1])\r\n" +
+		"\tby mx.example.com with ESMTPS id abc; Tue, 10 Jun 2025 10:00:00 +0000\r\n" +
+		"Received: from localhost by mail.evil.example; Tue, 10 Jun 2025 09:59:00 +0000\r\n" +
+		"From: Bank <support@bank.com>\r\n" +
+		"Reply-To: <support@bank.com>, <collect@evil.example>\r\n" +
+		"Date: Sat, 01 Jan 2022 00:00:00 +0000\r\n" +
+		"List-Unsubscribe: <mailto:unsubscribe@bank.com>\r\n" +
+		"Precedence: bulk\r\n" +
+		"X-Mailer: PHPMailer 6.0\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Body"
+	email := createTestEmail(raw)
+	sender, err := email.GetSender()
+	if err != nil {
+		t.Fatalf("GetSender returned error: %v", err)
+	}
+
+	context, signals := ExtractHeaderFeatures(email, sender, HeaderFeatures, nil, time.Now())
+	expectedContext := []string{
+		"REPLY-TO: <collect@evil.example> (a different domain from the sender)",
+		"FIRST EXTERNAL HOP: mail.evil.example (mail.evil.example [192.0.2.1]) to mx.example.com at 2025-06-10T10:00:00Z",
+		"MESSAGE-ID: missing",
+		"BULK SENDER: List-Unsubscribe, Precedence: bulk",
+		"DATE: Sat, 01 Jan 2022 00:00:00 +0000, 1256.4 days before the reception time",
+		"X-MAILER: PHPMailer 6.0",
+	}
+	if !reflect.DeepEqual(context, expectedContext) {
+		t.Errorf("Unexpected context:\n%q\nexpected:\n%q", context, expectedContext)
+	}
+	expectedSignals := []string{SignalReplyToMismatch, SignalMissingMessageID, SignalBulk, SignalDateSkew}
+	if !reflect.DeepEqual(signals, expectedSignals) {
+		t.Errorf("Unexpected signals %v, expected %v", signals, expectedSignals)
+	}
+
+	// Only the requested features are computed.
+	context, signals = ExtractHeaderFeatures(email, sender, []string{FeatureMailer}, nil, time.Now())
+	if len(context) != 1 || len(signals) != 0 {
+		t.Errorf("Expected only the mailer, got %v %v", context, signals)
+	}
+}
+
+func TestExtractHeaderFeaturesClean(t *testing.T) {
+	raw := "From: support@bank.com\r\n" +
+		"Reply-To: help@mail.bank.com\r\n" +
+		"Message-ID: <123@mailer.bank.com>\r\n" +
+		"Date: Tue, 10 Jun 2025 09:30:00 +0000\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Body"
+	email := createTestEmail(raw)
+	sender, err := email.GetSender()
+	if err != nil {
+		t.Fatalf("GetSender returned error: %v", err)
+	}
+	now := time.Date(2025, 6, 10, 10, 0, 0, 0, time.UTC)
+	context, signals := ExtractHeaderFeatures(email, sender, HeaderFeatures, nil, now)
+	if len(context) != 0 || len(signals) != 0 {
+		t.Errorf("Expected no features, got %v %v", context, signals)
+	}
+}
+
+func TestValidateHeaderFeatures(t *testing.T) {
+	if err := ValidateHeaderFeatures(HeaderFeatures); err != nil {
+		t.Errorf("ValidateHeaderFeatures returned error: %v", err)
+	}
+	if err := ValidateHeaderFeatures([]string{"reply_to", "colour"}); err == nil {
+		t.Error("Expected error for unknown feature")
+	}
+}
+
+func TestExtractHeaderFeaturesTrustedRelays(t *testing.T) {
+	raw := "Received: from filter.example.com (filter.example.com [203.0.113.5])\r\n" +
+		"\tby mx.example.com; Tue, 10 Jun 2025 10:00:01 +0000\r\n" +
+		"Received: from mail.evil.example (mail.evil.example [192.0.2.1])\r\n" +
+		"\tby filter.example.com; Tue, 10 Jun 2025 10:00:00 +0000\r\n" +
+		"From: support@bank.com\r\n" +
+		"Message-ID: <123@bank.com>\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Body"
+	email := createTestEmail(raw)
+	sender, err := email.GetSender()
+	if err != nil {
+		t.Fatalf("GetSender returned error: %v", err)
+	}
+	trusted, err := ParseTrustedRelays([]string{"203.0.113.5"})
+	if err != nil {
+		t.Fatalf("ParseTrustedRelays returned error: %v", err)
+	}
+	context, signals := ExtractHeaderFeatures(email, sender, []string{FeatureFirstHop, FeatureDateSkew}, trusted, time.Now())
+	expectedContext := []string{
+		"FIRST EXTERNAL HOP: mail.evil.example (mail.evil.example [192.0.2.1]) to filter.example.com at 2025-06-10T10:00:00Z",
+		"DATE: missing or invalid",
+	}
+	if !reflect.DeepEqual(context, expectedContext) {
+		t.Errorf("Unexpected context:\n%q\nexpected:\n%q", context, expectedContext)
+	}
+	if !reflect.DeepEqual(signals, []string{SignalInvalidDate}) {
+		t.Errorf("Unexpected signals %v, expected %v", signals, []string{SignalInvalidDate})
+	}
+}
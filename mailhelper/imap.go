@@ -2,8 +2,11 @@ package mailhelper
 
 import (
 	"fmt"
+	"log"
+
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/tmc/langchaingo/embeddings"
 )
 
 type IMAP struct {
@@ -96,3 +99,125 @@ func MoveEmails(c *client.Client, seqset *imap.SeqSet, destinationMailbox string
 	}
 	return nil
 }
+
+// scanNewMessages fetches items of the messages of mailbox after the last
+// one recorded in scans, calls handle for each of them and records the new
+// last UID. The whole mailbox is scanned again if its UIDs were reset. If the
+// fetch fails, the messages handled before are recorded anyway, so they are
+// not handled again on the next scan.
+func scanNewMessages(c *client.Client, mailbox string, scans map[string]MailboxScan, items []imap.FetchItem, handle func(*imap.Message)) error {
+	status, err := c.Select(mailbox, true)
+	if err != nil {
+		return fmt.Errorf("unable to select mailbox %q: %v", mailbox, err)
+	}
+	scan := scans[mailbox]
+	if scan.UIDValidity != status.UidValidity {
+		scan = MailboxScan{UIDValidity: status.UidValidity}
+	}
+	if status.Messages == 0 {
+		scans[mailbox] = scan
+		return nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(scan.LastUID+1, 0)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, append(items, imap.FetchUid), messages)
+	}()
+
+	lastUID := scan.LastUID
+	for msg := range messages {
+		// "N:*" always includes the last message, even if it is older than N.
+		if msg.Uid <= scan.LastUID {
+			continue
+		}
+		handle(msg)
+		if msg.Uid > lastUID {
+			lastUID = msg.Uid
+		}
+	}
+	scan.LastUID = lastUID
+	scans[mailbox] = scan
+	if err := <-done; err != nil {
+		return fmt.Errorf("fetch failed in mailbox %q: %v", mailbox, err)
+	}
+	return nil
+}
+
+// ScanSentMailbox adds the recipients of the messages in mailbox not scanned
+// yet to book, and returns how many new contacts were found.
+func ScanSentMailbox(c *client.Client, mailbox string, book *ContactBook) (int, error) {
+	added := 0
+	err := scanNewMessages(c, mailbox, book.Mailboxes, []imap.FetchItem{imap.FetchEnvelope, imap.FetchInternalDate}, func(msg *imap.Message) {
+		added += book.addRecipients(msg)
+	})
+	return added, err
+}
+
+// TrainBayes trains model with the messages in mailbox not used yet, as spam
+// or ham, and returns how many were learned.
+func TrainBayes(c *client.Client, mailbox string, spam bool, model *BayesModel) (int, error) {
+	learned := 0
+	section := &imap.BodySectionName{Peek: true}
+	err := scanNewMessages(c, mailbox, model.Mailboxes, []imap.FetchItem{section.FetchItem()}, func(msg *imap.Message) {
+		tokens, err := messageBayesTokens(msg)
+		if err != nil {
+			log.Printf("Error reading message %d of %s: %v", msg.Uid, mailbox, err)
+			return
+		}
+		model.Train(tokens, spam)
+		learned++
+	})
+	return learned, err
+}
+
+// embeddingBatchSize is the number of messages embedded per request.
+const embeddingBatchSize = 16
+
+// TrainKNN adds the embeddings of the messages in mailbox not used yet to
+// store, as spam or ham, and returns how many were added. If the embedder
+// fails, the messages not embedded are left for the next training.
+func TrainKNN(c *client.Client, mailbox string, spam bool, embedder embeddings.Embedder, store *VectorStore) (int, error) {
+	previous := store.Mailboxes[mailbox]
+	learned := 0
+	var batch []string
+	var batchUID, embeddedUID uint32
+	var embedErr error
+	flush := func() {
+		if embedErr == nil {
+			if embedErr = embedMessages(embedder, store, batch, spam); embedErr == nil {
+				learned += len(batch)
+				embeddedUID = batchUID
+			}
+		}
+		batch = batch[:0]
+	}
+	section := &imap.BodySectionName{Peek: true}
+	err := scanNewMessages(c, mailbox, store.Mailboxes, []imap.FetchItem{section.FetchItem()}, func(msg *imap.Message) {
+		if embedErr != nil {
+			return
+		}
+		text, err := messageEmbeddingText(msg)
+		if err != nil {
+			log.Printf("Error reading message %d of %s: %v", msg.Uid, mailbox, err)
+			return
+		}
+		batch, batchUID = append(batch, text), msg.Uid
+		if len(batch) == embeddingBatchSize {
+			flush()
+		}
+	})
+	flush()
+	if embedErr != nil {
+		scan := store.Mailboxes[mailbox]
+		if embeddedUID == 0 && scan.UIDValidity == previous.UIDValidity {
+			embeddedUID = previous.LastUID
+		}
+		scan.LastUID = embeddedUID
+		store.Mailboxes[mailbox] = scan
+		return learned, fmt.Errorf("error embedding messages of %q: %v", mailbox, embedErr)
+	}
+	return learned, err
+}
@@ -0,0 +1,240 @@
+package mailhelper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/mail"
+	"os"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/tmc/langchaingo/embeddings"
+)
+
+const (
+	// KNNAlone classifies with the k-NN score only, without the LLM, unless no
+	// known message is similar enough.
+	KNNAlone = "alone"
+	// KNNCombined blends the k-NN score with the LLM score. It is the default.
+	KNNCombined = "combined"
+)
+
+// maxEmbeddingChars caps the text embedded per message, under the context of
+// the usual embedding models.
+const maxEmbeddingChars = 8000
+
+// KNNPolicy configures the nearest-neighbour classifier: the K most similar
+// known messages vote, weighted by their similarity, and in combined mode the
+// result is weighted with the LLM score. Messages whose most similar known
+// message is under MinSimilarity are classified by the LLM only.
+type KNNPolicy struct {
+	Mode          string  `yaml:"mode"`
+	K             int     `yaml:"k"`
+	Weight        float64 `yaml:"weight"`
+	MinSimilarity float64 `yaml:"min_similarity"`
+}
+
+// Validate checks the mode, K, weight and minimum similarity.
+func (p KNNPolicy) Validate() error {
+	switch p.Mode {
+	case KNNAlone:
+	case "", KNNCombined:
+		if p.Weight < 0 || p.Weight > 1 {
+			return fmt.Errorf("combined k-NN weight must be between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("unknown k-NN mode %q", p.Mode)
+	}
+	if p.K < 1 {
+		return fmt.Errorf("k-NN k must be positive")
+	}
+	if p.MinSimilarity < 0 || p.MinSimilarity > 1 {
+		return fmt.Errorf("k-NN min_similarity must be between 0 and 1")
+	}
+	return nil
+}
+
+// LabeledVector is the embedding of a known spam or ham message.
+type LabeledVector struct {
+	Vector []float32 `json:"vector"`
+	Spam   bool      `json:"spam"`
+}
+
+// VectorStore is the persisted set of labeled embeddings the k-NN classifier
+// compares new messages with. Only the last MaxVectors are kept, if set.
+type VectorStore struct {
+	Vectors    []LabeledVector        `json:"vectors"`
+	Mailboxes  map[string]MailboxScan `json:"mailboxes"`
+	Filename   string                 `json:"-"`
+	MaxVectors int                    `json:"-"`
+	mu         sync.Mutex
+}
+
+// NewVectorStore loads the store saved in filename. A missing file is not an
+// error and results in an empty store.
+func NewVectorStore(filename string, maxVectors int) (*VectorStore, error) {
+	store := &VectorStore{
+		Mailboxes:  map[string]MailboxScan{},
+		Filename:   filename,
+		MaxVectors: maxVectors,
+	}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return store, err
+	}
+	if err := json.Unmarshal(data, store); err != nil {
+		return store, fmt.Errorf("error parsing vector store %s: %v", filename, err)
+	}
+	if store.Mailboxes == nil {
+		store.Mailboxes = map[string]MailboxScan{}
+	}
+	return store, nil
+}
+
+// Add stores the embedding of a message of the given class, dropping the
+// oldest ones over MaxVectors.
+func (s *VectorStore) Add(vector []float32, spam bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Vectors = append(s.Vectors, LabeledVector{Vector: vector, Spam: spam})
+	if s.MaxVectors > 0 && len(s.Vectors) > s.MaxVectors {
+		s.Vectors = append([]LabeledVector(nil), s.Vectors[len(s.Vectors)-s.MaxVectors:]...)
+	}
+}
+
+// Len returns the number of stored vectors.
+func (s *VectorStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Vectors)
+}
+
+// Save writes the store to its file.
+func (s *VectorStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.Filename, data, 0644)
+}
+
+// neighbour is a stored vector and its similarity to the query.
+type neighbour struct {
+	similarity float64
+	spam       bool
+}
+
+// Score returns the spam score, between 0 and 10, of the message embedded as
+// vector: the similarity-weighted share of spam among its k nearest
+// neighbours. It returns false if the store is empty or no known message has a
+// similarity of at least minSimilarity, as the neighbours would be unrelated.
+func (s *VectorStore) Score(vector []float32, k int, minSimilarity float64) (float64, string, bool) {
+	s.mu.Lock()
+	neighbours := make([]neighbour, 0, len(s.Vectors))
+	for _, stored := range s.Vectors {
+		// Vectors of another model (another dimension) are not comparable.
+		if len(stored.Vector) != len(vector) {
+			continue
+		}
+		neighbours = append(neighbours, neighbour{similarity: cosineSimilarity(stored.Vector, vector), spam: stored.Spam})
+	}
+	s.mu.Unlock()
+	if len(neighbours) == 0 {
+		return 0, "", false
+	}
+
+	sort.Slice(neighbours, func(i, j int) bool { return neighbours[i].similarity > neighbours[j].similarity })
+	if neighbours[0].similarity < minSimilarity {
+		return 0, "", false
+	}
+	if len(neighbours) > k {
+		neighbours = neighbours[:k]
+	}
+	var spamWeight, totalWeight float64
+	spamCount := 0
+	for _, n := range neighbours {
+		// Dissimilar messages do not vote.
+		weight := math.Max(n.similarity, 0)
+		totalWeight += weight
+		if n.spam {
+			spamWeight += weight
+			spamCount++
+		}
+	}
+	if totalWeight == 0 {
+		return 0, "", false
+	}
+	reason := fmt.Sprintf("%d of the %d most similar known messages are spam (best similarity %.2f)",
+		spamCount, len(neighbours), neighbours[0].similarity)
+	return 10 * spamWeight / totalWeight, reason, true
+}
+
+func cosineSimilarity(a []float32, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
+
+// EmbeddingText returns the text of a message that is embedded: its subject,
+// sender and body, cut at maxEmbeddingChars.
+func EmbeddingText(sender *mail.Address, subject string, body string) string {
+	text := formatEmail(sender, subject, nil, body)
+	if len(text) > maxEmbeddingChars {
+		text = text[:maxEmbeddingChars]
+		// Do not leave half a character.
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return text
+}
+
+// messageEmbeddingText returns the embedding text of a fetched message.
+func messageEmbeddingText(msg *imap.Message) (string, error) {
+	email, err := NewEmail(msg)
+	if err != nil {
+		return "", err
+	}
+	sender, err := email.GetSender()
+	if err != nil {
+		sender = &mail.Address{}
+	}
+	content, err := ParseEmailContent(email)
+	if err != nil {
+		return "", err
+	}
+	return EmbeddingText(sender, email.GetSubject(), content.Text), nil
+}
+
+// embedMessages embeds the texts with embedder and adds them to store as spam
+// or ham.
+func embedMessages(embedder embeddings.Embedder, store *VectorStore, texts []string, spam bool) error {
+	if len(texts) == 0 {
+		return nil
+	}
+	vectors, err := embedder.EmbedDocuments(context.Background(), texts)
+	if err != nil {
+		return err
+	}
+	for _, vector := range vectors {
+		store.Add(vector, spam)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package mailhelper
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// fakeEmbedder embeds texts by counting the words of a small vocabulary.
+type fakeEmbedder struct{}
+
+var fakeVocabulary = []string{"viagra", "lottery", "prize", "meeting", "notes", "project"}
+
+func (fakeEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	vector := make([]float32, len(fakeVocabulary))
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		for i, known := range fakeVocabulary {
+			if strings.Trim(word, ".,!?") == known {
+				vector[i]++
+			}
+		}
+	}
+	return vector, nil
+}
+
+func (e fakeEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	var vectors [][]float32
+	for _, text := range texts {
+		vector, _ := e.EmbedQuery(ctx, text)
+		vectors = append(vectors, vector)
+	}
+	return vectors, nil
+}
+
+// trainedVectorStore returns a store with a few obvious spam and ham messages.
+func trainedVectorStore(t *testing.T, path string) *VectorStore {
+	t.Helper()
+	store, err := NewVectorStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewVectorStore returned error: %v", err)
+	}
+	spam := []string{"Cheap viagra", "You won the lottery prize", "Claim your prize"}
+	ham := []string{"Meeting notes", "Notes of the project", "Project meeting tomorrow"}
+	if err := embedMessages(fakeEmbedder{}, store, spam, true); err != nil {
+		t.Fatalf("embedMessages returned error: %v", err)
+	}
+	if err := embedMessages(fakeEmbedder{}, store, ham, false); err != nil {
+		t.Fatalf("embedMessages returned error: %v", err)
+	}
+	return store
+}
+
+func TestVectorStore(t *testing.T) {
+	path := t.TempDir() + "/vectors.json"
+	store := trainedVectorStore(t, path)
+	embed := func(text string) []float32 {
+		vector, _ := fakeEmbedder{}.EmbedQuery(context.Background(), text)
+		return vector
+	}
+
+	score, reason, ok := store.Score(embed("Your lottery prize is waiting"), 3, 0)
+	if !ok || score != 10 {
+		t.Errorf("Expected spam, got %v, %v", score, ok)
+	}
+	if !strings.HasPrefix(reason, "3 of the 3 most similar known messages are spam") {
+		t.Errorf("Unexpected reason %q", reason)
+	}
+	if score, _, ok := store.Score(embed("Notes of the meeting"), 3, 0); !ok || score != 0 {
+		t.Errorf("Expected ham, got %v, %v", score, ok)
+	}
+	if _, _, ok := store.Score(embed("Nothing known here"), 3, 0); ok {
+		t.Error("Expected no score for a message unlike any known one")
+	}
+	if _, _, ok := store.Score([]float32{1, 2}, 3, 0); ok {
+		t.Error("Expected no score for vectors of another dimension")
+	}
+	// Its most similar known messages share only one of its two words.
+	if _, _, ok := store.Score(embed("Lottery notes"), 3, 0.9); ok {
+		t.Error("Expected no score under the minimum similarity")
+	}
+	if _, _, ok := store.Score(embed("Lottery notes"), 3, 0.5); !ok {
+		t.Error("Expected a score at the minimum similarity")
+	}
+
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	loaded, err := NewVectorStore(path, 2)
+	if err != nil {
+		t.Fatalf("NewVectorStore returned error: %v", err)
+	}
+	if loaded.Len() != 6 {
+		t.Errorf("Expected 6 vectors, got %d", loaded.Len())
+	}
+	loaded.Add(embed("prize"), true)
+	if loaded.Len() != 2 || !loaded.Vectors[1].Spam {
+		t.Errorf("Expected only the 2 most recent vectors, got %+v", loaded.Vectors)
+	}
+}
+
+func TestKNNPolicyValidate(t *testing.T) {
+	valid := []KNNPolicy{{K: 5}, {Mode: KNNAlone, K: 1}, {Mode: KNNCombined, K: 3, Weight: 0.5, MinSimilarity: 0.5}}
+	for _, policy := range valid {
+		if err := policy.Validate(); err != nil {
+			t.Errorf("Validate(%+v) returned error: %v", policy, err)
+		}
+	}
+	invalid := []KNNPolicy{{K: 0}, {Mode: "other", K: 5}, {Mode: KNNCombined, K: 5, Weight: 2}, {K: 5, MinSimilarity: 1.5}}
+	for _, policy := range invalid {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("Expected error for %+v", policy)
+		}
+	}
+}
+
+func TestEmbeddingText(t *testing.T) {
+	sender := &mail.Address{Address: "sender@example.com"}
+	if got := EmbeddingText(sender, "Hello", "Body"); got != "FROM: <sender@example.com>\nSUBJECT: Hello\n\nBody" {
+		t.Errorf("EmbeddingText() = %q", got)
+	}
+	long := EmbeddingText(sender, "Hello", strings.Repeat("é", maxEmbeddingChars))
+	if len(long) > maxEmbeddingChars || !strings.HasSuffix(long, "é") {
+		t.Errorf("Expected the text to be cut at a character boundary, got %d bytes", len(long))
+	}
+}
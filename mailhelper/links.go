@@ -0,0 +1,244 @@
+package mailhelper
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// LinkTextMismatch flags links whose text shows a domain different from
+	// the one the link actually goes to.
+	LinkTextMismatch = "TEXT_MISMATCH"
+	// LinkIPLiteral flags links to an IP address instead of a host name.
+	LinkIPLiteral = "IP_LITERAL"
+	// LinkPunycode flags links to internationalized (punycode) host names.
+	LinkPunycode = "PUNYCODE"
+	// LinkRedirect flags links wrapped by a redirector or tracking service.
+	LinkRedirect = "REDIRECT"
+)
+
+// maxRedirects limits how many nested redirectors are unwrapped.
+const maxRedirects = 5
+
+// Link is a link found in an email and its real destination.
+type Link struct {
+	Text        string
+	Href        string
+	Destination string
+	Host        string
+	Flags       []string
+}
+
+// String formats the link for the LLM prompt.
+func (l Link) String() string {
+	var builder strings.Builder
+	if l.Text != "" {
+		fmt.Fprintf(&builder, "%q ", l.Text)
+	}
+	builder.WriteString(l.Href)
+	if l.Destination != l.Href {
+		fmt.Fprintf(&builder, " -> %s", l.Destination)
+	}
+	fmt.Fprintf(&builder, " (host %s)", l.Host)
+	if len(l.Flags) > 0 {
+		fmt.Fprintf(&builder, " [%s]", strings.Join(l.Flags, ", "))
+	}
+	return builder.String()
+}
+
+// hostnameRe matches host names.
+var hostnameRe = regexp.MustCompile(`(?i)^(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}$`)
+
+// shownDomain returns the first domain displayed in the text of a link: a
+// word that is a host name, a URL or an email address whose suffix is an ICANN
+// public suffix. Dotted words like the file name "invoice.pdf" are not
+// domains.
+func shownDomain(text string) string {
+	for _, word := range strings.Fields(text) {
+		word = strings.Trim(word, "()[]<>\"'.,;:!?")
+		host := word
+		if u, err := url.Parse(word); err == nil && u.Host != "" {
+			host = u.Hostname()
+		} else {
+			host, _, _ = strings.Cut(host, "/")
+			host = host[strings.LastIndex(host, "@")+1:]
+		}
+		host = strings.ToLower(host)
+		if !hostnameRe.MatchString(host) {
+			continue
+		}
+		if suffix, icann := publicsuffix.PublicSuffix(host); icann && suffix != host {
+			return host
+		}
+	}
+	return ""
+}
+
+// redirectParams are the query parameters redirectors and tracking wrappers
+// commonly use to carry the destination URL.
+var redirectParams = []string{"url", "u", "q", "target", "dest", "destination", "redirect", "redirect_url", "redirect_uri", "link", "r"}
+
+// extractLinks returns the links of the anchors in an HTML document.
+func extractLinks(n *html.Node) []Link {
+	var links []Link
+	if n.Type == html.ElementNode && n.Data == "a" {
+		for _, attr := range n.Attr {
+			if attr.Key == "href" {
+				if link, ok := analyzeLink(strings.TrimSpace(extractText(n)), attr.Val); ok {
+					links = append(links, link)
+				}
+			}
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		links = append(links, extractLinks(c)...)
+	}
+	return links
+}
+
+// extractTextLinks returns the bare URLs found in plain text.
+func extractTextLinks(text string) []Link {
+	var links []Link
+	for _, href := range urlRe.FindAllString(text, -1) {
+		// Punctuation ending a sentence is not part of the URL.
+		href = strings.TrimRight(href, ".,;:!?")
+		if link, ok := analyzeLink("", href); ok {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// analyzeLink unwraps the redirectors of href and flags anything suspicious.
+// Only http and https links are returned.
+func analyzeLink(text string, href string) (Link, bool) {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return Link{}, false
+	}
+	link := Link{Text: strings.Join(strings.Fields(text), " "), Href: href}
+
+	for i := 0; i < maxRedirects; i++ {
+		next, ok := unwrapRedirect(u)
+		if !ok {
+			break
+		}
+		u = next
+		if i == 0 {
+			link.Flags = append(link.Flags, LinkRedirect)
+		}
+	}
+	link.Destination = u.String()
+	link.Host = strings.ToLower(u.Hostname())
+
+	if net.ParseIP(link.Host) != nil {
+		link.Flags = append(link.Flags, LinkIPLiteral)
+	}
+	if strings.HasPrefix(link.Host, "xn--") || strings.Contains(link.Host, ".xn--") {
+		link.Flags = append(link.Flags, LinkPunycode)
+		if unicodeHost, err := idna.ToUnicode(link.Host); err == nil {
+			link.Host = fmt.Sprintf("%s (%s)", link.Host, unicodeHost)
+		}
+	}
+	if shown := shownDomain(link.Text); shown != "" && !sameSite(shown, u.Hostname()) {
+		link.Flags = append(link.Flags, LinkTextMismatch)
+	}
+	return link, true
+}
+
+// unwrapRedirect returns the destination of known redirectors: Google,
+// Outlook safe links, Facebook, Proofpoint URL Defense and any URL carrying
+// another absolute URL in a usual redirect parameter.
+func unwrapRedirect(u *url.URL) (*url.URL, bool) {
+	host := strings.ToLower(u.Hostname())
+	query := u.Query()
+
+	if host == "urldefense.com" && strings.HasPrefix(u.Path, "/v3/__") {
+		// https://urldefense.com/v3/__https://example.com/__;!!token
+		raw := strings.TrimPrefix(u.EscapedPath(), "/v3/__")
+		if end := strings.Index(raw, "__"); end > 0 {
+			raw = raw[:end]
+		}
+		if decoded, err := url.PathUnescape(raw); err == nil {
+			raw = decoded
+		}
+		return parseAbsoluteURL(raw)
+	}
+	if host == "urldefense.proofpoint.com" && strings.HasPrefix(u.Path, "/v2/url") {
+		// The u parameter encodes % as - and / as _
+		raw := strings.NewReplacer("-", "%", "_", "/").Replace(query.Get("u"))
+		if decoded, err := url.QueryUnescape(raw); err == nil {
+			return parseAbsoluteURL(decoded)
+		}
+	}
+
+	for _, param := range redirectParams {
+		if next, ok := parseAbsoluteURL(query.Get(param)); ok {
+			return next, true
+		}
+	}
+	return nil, false
+}
+
+func parseAbsoluteURL(raw string) (*url.URL, bool) {
+	if !strings.HasPrefix(raw, "http://") && !strings.HasPrefix(raw, "https://") {
+		return nil, false
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+// sameSite returns true if both hosts belong to the same registrable domain,
+// e.g. www.paypal.com and paypal.com.
+func sameSite(a string, b string) bool {
+	a, b = strings.ToLower(strings.TrimSuffix(a, ".")), strings.ToLower(strings.TrimSuffix(b, "."))
+	siteA, errA := publicsuffix.EffectiveTLDPlusOne(a)
+	siteB, errB := publicsuffix.EffectiveTLDPlusOne(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return siteA == siteB
+}
+
+// dedupLinks removes repeated links keeping the first occurrence.
+func dedupLinks(links []Link) []Link {
+	seen := map[string]bool{}
+	var unique []Link
+	for _, link := range links {
+		key := link.Text + "\x00" + link.Href
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, link)
+	}
+	return unique
+}
+
+// SummarizeLinks formats up to maxLinks links for the LLM prompt, flagged links
+// first.
+func SummarizeLinks(links []Link, maxLinks int) []string {
+	var flagged, other []string
+	for _, link := range links {
+		if len(link.Flags) > 0 {
+			flagged = append(flagged, "- "+link.String())
+		} else {
+			other = append(other, "- "+link.String())
+		}
+	}
+	lines := append(flagged, other...)
+	if len(lines) > maxLinks {
+		lines = append(lines[:maxLinks], fmt.Sprintf("- ... and %d more links", len(lines)-maxLinks))
+	}
+	return lines
+}
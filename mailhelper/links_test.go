@@ -0,0 +1,165 @@
+package mailhelper
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestAnalyzeLink(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		href        string
+		destination string
+		flags       []string
+	}{
+		{
+			name:        "plain link",
+			text:        "Read more",
+			href:        "https://example.com/article",
+			destination: "https://example.com/article",
+		},
+		{
+			name:        "text matches subdomain",
+			text:        "www.paypal.com",
+			href:        "https://paypal.com/signin",
+			destination: "https://paypal.com/signin",
+		},
+		{
+			name:        "text shows another domain",
+			text:        "Login to PayPal.com",
+			href:        "http://paypal-secure.example.net/login",
+			destination: "http://paypal-secure.example.net/login",
+			flags:       []string{LinkTextMismatch},
+		},
+		{
+			name:        "text shows a file name",
+			text:        "Download invoice.pdf or report.docx",
+			href:        "https://files.example.com/invoice.pdf",
+			destination: "https://files.example.com/invoice.pdf",
+		},
+		{
+			name:        "text shows a url",
+			text:        "(https://www.paypal.com/signin)",
+			href:        "https://evil.example.net/",
+			destination: "https://evil.example.net/",
+			flags:       []string{LinkTextMismatch},
+		},
+		{
+			name:        "google redirector",
+			text:        "paypal.com",
+			href:        "https://www.google.com/url?q=https%3A%2F%2Fevil.example.org%2Fx&sa=D",
+			destination: "https://evil.example.org/x",
+			flags:       []string{LinkRedirect, LinkTextMismatch},
+		},
+		{
+			name:        "outlook safe links",
+			text:        "",
+			href:        "https://eur01.safelinks.protection.outlook.com/?url=https%3A%2F%2Fexample.com%2F&data=abc",
+			destination: "https://example.com/",
+			flags:       []string{LinkRedirect},
+		},
+		{
+			name:        "proofpoint v2",
+			text:        "",
+			href:        "https://urldefense.proofpoint.com/v2/url?u=https-3A__example.com_path&d=x",
+			destination: "https://example.com/path",
+			flags:       []string{LinkRedirect},
+		},
+		{
+			name:        "proofpoint v3",
+			text:        "",
+			href:        "https://urldefense.com/v3/__https://example.com/path__;!!token$",
+			destination: "https://example.com/path",
+			flags:       []string{LinkRedirect},
+		},
+		{
+			name:        "nested redirectors",
+			text:        "",
+			href:        "https://l.facebook.com/l.php?u=https%3A%2F%2Fwww.google.com%2Furl%3Fq%3Dhttp%3A%2F%2F192.168.1.10%2Flogin",
+			destination: "http://192.168.1.10/login",
+			flags:       []string{LinkRedirect, LinkIPLiteral},
+		},
+		{
+			name:        "punycode host",
+			text:        "",
+			href:        "https://xn--pypal-4ve.com/",
+			destination: "https://xn--pypal-4ve.com/",
+			flags:       []string{LinkPunycode},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link, ok := analyzeLink(tt.text, tt.href)
+			if !ok {
+				t.Fatalf("analyzeLink(%q) returned false", tt.href)
+			}
+			if link.Destination != tt.destination {
+				t.Errorf("Expected destination %q, got %q", tt.destination, link.Destination)
+			}
+			if !reflect.DeepEqual(link.Flags, tt.flags) {
+				t.Errorf("Expected flags %v, got %v", tt.flags, link.Flags)
+			}
+		})
+	}
+
+	for _, href := range []string{"mailto:user@example.com", "javascript:alert(1)", "/relative"} {
+		if _, ok := analyzeLink("", href); ok {
+			t.Errorf("Expected %q to be ignored", href)
+		}
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(
+		`<p>Hi <a href="https://evil.example.net/">paypal.com</a> and <a href="https://example.com">here</a> <a>no href</a></p>`))
+	if err != nil {
+		t.Fatalf("html.Parse returned error: %v", err)
+	}
+	links := extractLinks(doc)
+	if len(links) != 2 {
+		t.Fatalf("Expected 2 links, got %+v", links)
+	}
+	if links[0].Text != "paypal.com" || links[0].Host != "evil.example.net" {
+		t.Errorf("Unexpected first link %+v", links[0])
+	}
+
+	textLinks := extractTextLinks("Visit https://example.com/a, or http://example.org.")
+	if len(textLinks) != 2 || textLinks[0].Href != "https://example.com/a" || textLinks[1].Href != "http://example.org" {
+		t.Errorf("Unexpected text links %+v", textLinks)
+	}
+}
+
+func TestSummarizeLinks(t *testing.T) {
+	links := []Link{
+		{Href: "https://a.com", Destination: "https://a.com", Host: "a.com"},
+		{Text: "paypal.com", Href: "https://b.com", Destination: "https://b.com", Host: "b.com", Flags: []string{LinkTextMismatch}},
+		{Href: "https://c.com", Destination: "https://c.com", Host: "c.com"},
+	}
+	got := SummarizeLinks(links, 2)
+	want := []string{
+		`- "paypal.com" https://b.com (host b.com) [TEXT_MISMATCH]`,
+		"- https://a.com (host a.com)",
+		"- ... and 1 more links",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestParseEmailContentLinks(t *testing.T) {
+	email := createEmail("text/html", []byte(`<a href="https://evil.example.net/">paypal.com</a><a href="https://evil.example.net/">paypal.com</a>`))
+	content, err := ParseEmailContent(email)
+	if err != nil {
+		t.Fatalf("ParseEmailContent returned error: %v", err)
+	}
+	if content.Text != "paypal.com paypal.com " {
+		t.Errorf("Unexpected text %q", content.Text)
+	}
+	if len(content.Links) != 1 || content.Links[0].Flags[0] != LinkTextMismatch {
+		t.Errorf("Expected one deduplicated mismatched link, got %+v", content.Links)
+	}
+}
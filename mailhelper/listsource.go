@@ -0,0 +1,173 @@
+package mailhelper
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listFile is a list file and the state it was loaded at.
+type listFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// ListSource builds a SenderList from inline entries and list files, given as
+// "file:///etc/llm-antispam/whitelist.txt" or "file:lists/whitelist.txt"
+// entries. List files hold one entry per line; blank lines and # comments are
+// ignored. The list is reloaded whenever a file changes.
+type ListSource struct {
+	entries  []string
+	files    []listFile
+	list     *SenderList
+	validate func(*SenderList) error
+	mu       sync.Mutex
+}
+
+// NewListSource loads the entries and list files.
+func NewListSource(entries []string) (*ListSource, error) {
+	source := &ListSource{entries: entries}
+	if err := source.load(); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// NewWhitelistSource works like NewListSource and also refuses the entries
+// that cannot be used in a whitelist, on load and on reload.
+func NewWhitelistSource(entries []string) (*ListSource, error) {
+	source := &ListSource{entries: entries, validate: (*SenderList).ValidateWhitelist}
+	if err := source.load(); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// listFilePath returns the path of a file: entry.
+func listFilePath(entry string) (string, bool, error) {
+	if !strings.HasPrefix(entry, "file:") {
+		return "", false, nil
+	}
+	u, err := url.Parse(entry)
+	if err != nil {
+		return "", true, fmt.Errorf("invalid list file %q: %v", entry, err)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", true, fmt.Errorf("invalid list file %q: only local files are supported", entry)
+	}
+	path := u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return "", true, fmt.Errorf("invalid list file %q: missing path", entry)
+	}
+	return path, true, nil
+}
+
+// readListFile returns the entries of a list file.
+func readListFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Printf("error closing %s: %v", path, err)
+		}
+	}()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "file:") {
+			return nil, fmt.Errorf("%s: list files cannot include other files", path)
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return entries, nil
+}
+
+// load reads all the list files and rebuilds the list.
+func (s *ListSource) load() error {
+	var entries []string
+	var files []listFile
+	for _, entry := range s.entries {
+		path, isFile, err := listFilePath(entry)
+		if err != nil {
+			return err
+		}
+		if !isFile {
+			entries = append(entries, entry)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		fileEntries, err := readListFile(path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, fileEntries...)
+		files = append(files, listFile{path: path, modTime: info.ModTime(), size: info.Size()})
+	}
+	list, err := ParseSenderList(entries)
+	if err != nil {
+		return err
+	}
+	if s.validate != nil {
+		if err := s.validate(list); err != nil {
+			return err
+		}
+	}
+	s.list = list
+	s.files = files
+	return nil
+}
+
+// changed returns true if any list file changed since it was loaded.
+func (s *ListSource) changed() bool {
+	for _, file := range s.files {
+		info, err := os.Stat(file.path)
+		if err != nil || !info.ModTime().Equal(file.modTime) || info.Size() != file.size {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the current list, reloading the list files if they changed.
+// If the reload fails the previous list is kept.
+func (s *ListSource) List() *SenderList {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.changed() {
+		if err := s.load(); err != nil {
+			log.Printf("Error reloading sender list, keeping the previous one: %v", err)
+		} else {
+			log.Printf("Sender list reloaded")
+		}
+	}
+	return s.list
+}
@@ -0,0 +1,73 @@
+package mailhelper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.txt")
+	if err := os.WriteFile(path, []byte("# Partners\n\npartner.com # main domain\n*.partner.net\n"), 0644); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	source, err := NewListSource([]string{"gmail.com", "file://" + path})
+	if err != nil {
+		t.Fatalf("NewListSource returned error: %v", err)
+	}
+	email := createTestEmail("From: john@shop.partner.net\r\nSubject: Hi\r\n\r\nBody")
+	sender, err := email.GetSender()
+	if err != nil {
+		t.Fatalf("GetSender returned error: %v", err)
+	}
+	if entry, ok := source.List().Match(email, sender); !ok || entry != "*.partner.net" {
+		t.Errorf("Match() = %q, %v, want *.partner.net", entry, ok)
+	}
+
+	// Changes are picked up on the next List call.
+	if err := os.WriteFile(path, []byte("partner.com\n"), 0644); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("Chtimes returned error: %v", err)
+	}
+	if entry, ok := source.List().Match(email, sender); ok {
+		t.Errorf("Expected no match after reload, got %q", entry)
+	}
+
+	// A broken file keeps the previous list.
+	if err := os.WriteFile(path, []byte("re:(\n"), 0644); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	if err := os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute)); err != nil {
+		t.Fatalf("Chtimes returned error: %v", err)
+	}
+	partner := createTestEmail("From: john@partner.com\r\nSubject: Hi\r\n\r\nBody")
+	partnerSender, err := partner.GetSender()
+	if err != nil {
+		t.Fatalf("GetSender returned error: %v", err)
+	}
+	if _, ok := source.List().Match(partner, partnerSender); !ok {
+		t.Error("Expected the previous list to be kept")
+	}
+}
+
+func TestListSourceErrors(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "nested.txt")
+	if err := os.WriteFile(nested, []byte("file:other.txt\n"), 0644); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+	for _, entry := range []string{
+		"file://" + filepath.Join(dir, "missing.txt"),
+		"file://remote.example.com/whitelist.txt",
+		"file:" + nested,
+		"file:",
+	} {
+		if _, err := NewListSource([]string{entry}); err == nil {
+			t.Errorf("Expected error for %q", entry)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package mailhelper
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SignalLookalike is raised by senders whose domain is confusable with a
+// whitelisted or well-known brand domain.
+const SignalLookalike = "sender:lookalike"
+
+// BrandDomains are well-known domains commonly impersonated by phishing.
+var BrandDomains = []string{
+	"paypal.com", "apple.com", "icloud.com", "microsoft.com", "office.com", "outlook.com",
+	"live.com", "google.com", "gmail.com", "amazon.com", "facebook.com", "instagram.com",
+	"netflix.com", "linkedin.com", "github.com", "dropbox.com", "docusign.com", "adobe.com",
+	"dhl.com", "fedex.com", "ups.com", "chase.com", "wellsfargo.com", "bankofamerica.com",
+}
+
+// NormalizeDomain returns the canonical form of a domain for comparisons:
+// lowercase, without trailing dot and with internationalized labels in their
+// punycode (ASCII) form. Invalid domains are only lowercased.
+func NormalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if ascii, err := idna.ToASCII(domain); err == nil {
+		return ascii
+	}
+	return domain
+}
+
+// confusables maps characters to the ASCII letter they look like. It covers
+// the Cyrillic and Greek homoglyphs and the digits used in lookalike domains.
+var confusables = map[rune]string{
+	// Cyrillic
+	'а': "a", 'в': "b", 'е': "e", 'ё': "e", 'һ': "h", 'і': "i", 'ї': "i", 'ј': "j", 'к': "k",
+	'м': "m", 'н': "h", 'о': "o", 'р': "p", 'с': "c", 'т': "t", 'у': "y", 'х': "x",
+	'ѕ': "s", 'ԁ': "d", 'ԛ': "q", 'ԝ': "w", 'ɡ': "g", 'ӏ': "l",
+	// Greek
+	'α': "a", 'β': "b", 'ε': "e", 'η': "n", 'ι': "i", 'κ': "k", 'ν': "v", 'ο': "o",
+	'ρ': "p", 'τ': "t", 'υ': "u", 'χ': "x", 'ω': "w",
+	// Latin lookalikes
+	'ı': "i", 'ł': "l", 'ø': "o", 'đ': "d", 'ħ': "h",
+	// Digits
+	'0': "o", '1': "l", '3': "e", '5': "s",
+}
+
+// skeletonSequences are multi-letter lookalikes of a single letter. They are
+// only folded in the checked domain, as folding the protected ones too would
+// flag ordinary domains, e.g. dear.com for a protected clear.com.
+var skeletonSequences = strings.NewReplacer("rn", "m", "vv", "w", "cl", "d")
+
+// skeleton reduces a domain to a form where confusable domains are equal,
+// e.g. pаypal.com (Cyrillic а), paypa1.com and paypal.com. Lowercase i and l
+// are told apart in domain names, so they are not folded: mall.com is not a
+// lookalike of mail.com.
+func skeleton(domain string) string {
+	if unicodeDomain, err := idna.ToUnicode(domain); err == nil {
+		domain = unicodeDomain
+	}
+	var builder strings.Builder
+	// NFD splits the diacritics, which are dropped.
+	for _, r := range norm.NFD.String(strings.ToLower(domain)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if replacement, ok := confusables[r]; ok {
+			builder.WriteString(replacement)
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// looseSkeleton is the skeleton of a checked domain, as written in the
+// message, with the multi-letter lookalikes folded too, e.g. rnicrosoft.com.
+// An uppercase I, which looks like a lowercase l, is folded before the domain
+// is lowercased, e.g. PaypaI.com.
+func looseSkeleton(domain string) string {
+	site := registrableDomain(NormalizeDomain(strings.ReplaceAll(domain, "I", "l")))
+	return skeletonSequences.Replace(skeleton(site))
+}
+
+// registrableDomain returns the domain registered under its public suffix,
+// e.g. paypal.com for www.paypal.com.
+func registrableDomain(domain string) string {
+	if site, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return site
+	}
+	return domain
+}
+
+// LookalikeDetector flags domains confusable with a set of protected domains.
+type LookalikeDetector struct {
+	domains   map[string]bool
+	skeletons map[string]string
+}
+
+// NewLookalikeDetector protects the registrable domains of domains.
+func NewLookalikeDetector(domains []string) *LookalikeDetector {
+	detector := &LookalikeDetector{domains: map[string]bool{}, skeletons: map[string]string{}}
+	for _, domain := range domains {
+		site := registrableDomain(NormalizeDomain(domain))
+		if site == "" || detector.domains[site] {
+			continue
+		}
+		detector.domains[site] = true
+		detector.skeletons[skeleton(site)] = site
+	}
+	return detector
+}
+
+// Check returns the protected domain that domain, as written in the message,
+// imitates, if any. The protected domains and their subdomains are not
+// lookalikes.
+func (d *LookalikeDetector) Check(domain string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	site := registrableDomain(NormalizeDomain(domain))
+	if d.domains[site] {
+		return "", false
+	}
+	if protected, ok := d.skeletons[skeleton(site)]; ok {
+		return protected, true
+	}
+	protected, ok := d.skeletons[looseSkeleton(domain)]
+	return protected, ok
+}
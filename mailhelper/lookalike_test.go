@@ -0,0 +1,53 @@
+package mailhelper
+
+import "testing"
+
+func TestNormalizeDomain(t *testing.T) {
+	tests := map[string]string{
+		"Example.COM.":     "example.com",
+		" bücher.de ":      "xn--bcher-kva.de",
+		"XN--BCHER-KVA.DE": "xn--bcher-kva.de",
+		"under_score.com":  "under_score.com",
+	}
+	for domain, want := range tests {
+		if got := NormalizeDomain(domain); got != want {
+			t.Errorf("NormalizeDomain(%q) = %q, want %q", domain, got, want)
+		}
+	}
+}
+
+func TestLookalikeDetector(t *testing.T) {
+	detector := NewLookalikeDetector([]string{"paypal.com", "microsoft.com", "*.mybank.com", "mybank.com", "mail.com", "clear.com"})
+	tests := []struct {
+		domain    string
+		protected string
+		lookalike bool
+	}{
+		{domain: "paypal.com"},
+		{domain: "www.PayPal.com."},
+		{domain: "example.com"},
+		{domain: "pаypal.com", protected: "paypal.com", lookalike: true}, // Cyrillic а
+		{domain: "xn--pypal-4ve.com", protected: "paypal.com", lookalike: true},
+		{domain: "mail.paypa1.com", protected: "paypal.com", lookalike: true},
+		{domain: "rnicrosoft.com", protected: "microsoft.com", lookalike: true},
+		{domain: "mybänk.com", protected: "mybank.com", lookalike: true},
+		{domain: "paypal.co.uk"},
+		{domain: "PaypaI.com", protected: "paypal.com", lookalike: true}, // uppercase I
+		{domain: "Info.paypal.com"},
+		{domain: "mall.com"},
+		{domain: "MAIL.com"},
+		{domain: "dear.com"},
+		{domain: "cllear.com"},
+		{domain: "paypai.com"},
+	}
+	for _, tt := range tests {
+		protected, lookalike := detector.Check(tt.domain)
+		if lookalike != tt.lookalike || protected != tt.protected {
+			t.Errorf("Check(%q) = %q, %v, want %q, %v", tt.domain, protected, lookalike, tt.protected, tt.lookalike)
+		}
+	}
+	var disabled *LookalikeDetector
+	if _, ok := disabled.Check("pаypal.com"); ok {
+		t.Error("Expected a nil detector to flag nothing")
+	}
+}
@@ -0,0 +1,327 @@
+package mailhelper
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// ReceivedResidential flags an origin whose reverse DNS looks like a
+	// residential or dynamic address.
+	ReceivedResidential = "RESIDENTIAL"
+	// ReceivedNoReverseDNS flags an origin without reverse DNS.
+	ReceivedNoReverseDNS = "NO_REVERSE_DNS"
+	// ReceivedHeloMismatch flags an origin whose HELO name does not match its
+	// reverse DNS.
+	ReceivedHeloMismatch = "HELO_MISMATCH"
+)
+
+// maxPromptHops is the maximum number of relays listed in the prompt.
+const maxPromptHops = 10
+
+// Hop is a relay of the path of a message, as recorded by the server that
+// received it in a Received header.
+type Hop struct {
+	// Helo is the name the sending host announced.
+	Helo string
+	// ReverseDNS is the name of the sending IP, empty if unknown.
+	ReverseDNS string
+	IP         net.IP
+	// By is the receiving server.
+	By   string
+	With string
+	Date time.Time
+}
+
+// String formats the hop for the LLM prompt.
+func (h Hop) String() string {
+	var builder strings.Builder
+	builder.WriteString(h.Helo)
+	if h.IP != nil {
+		rdns := h.ReverseDNS
+		if rdns == "" {
+			rdns = "unknown"
+		}
+		fmt.Fprintf(&builder, " (%s [%s])", rdns, h.IP)
+	}
+	if h.By != "" {
+		builder.WriteString(" to " + h.By)
+	}
+	if !h.Date.IsZero() {
+		builder.WriteString(" at " + h.Date.Format(time.RFC3339))
+	}
+	return strings.TrimSpace(builder.String())
+}
+
+var (
+	receivedIPRe   = regexp.MustCompile(`\[(?:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+	receivedHeloRe = regexp.MustCompile(`(?i)\bhelo=([^\s)]+)`)
+	// residentialRe matches the words ISPs use in the names of dynamic and
+	// residential addresses.
+	residentialRe = regexp.MustCompile(`(?i)(^|[.-])(dyn|dynamic|dsl|adsl|vdsl|xdsl|cable|pool|dhcp|ppp|pppoe|dialup|dial|broadband|cust|customer|client|res|residential|home|ftth|fiber|fibre|mobile|cpe)([.-]|\d|$)`)
+	numberRe      = regexp.MustCompile(`\d+`)
+)
+
+// receivedKeywords start the clauses of a Received header.
+var receivedKeywords = map[string]bool{"from": true, "by": true, "via": true, "with": true, "id": true, "for": true}
+
+// ParseReceived parses the value of a Received header.
+func ParseReceived(value string) (Hop, error) {
+	var hop Hop
+	value = strings.Join(strings.Fields(value), " ")
+	if i := strings.LastIndex(value, ";"); i >= 0 {
+		date, err := parseReceivedDate(value[i+1:])
+		if err == nil {
+			hop.Date = date
+		}
+		value = value[:i]
+	}
+
+	// Split the clauses on the keywords outside of comments.
+	clauses := map[string]string{}
+	keyword := ""
+	depth := 0
+	for _, token := range strings.Split(value, " ") {
+		if depth == 0 && receivedKeywords[strings.ToLower(token)] {
+			keyword = strings.ToLower(token)
+			if _, ok := clauses[keyword]; ok {
+				// Only the first occurrence of a clause counts.
+				keyword = "ignored"
+			}
+			clauses[keyword] = ""
+			continue
+		}
+		depth += strings.Count(token, "(") - strings.Count(token, ")")
+		if depth < 0 {
+			depth = 0
+		}
+		if keyword != "" {
+			clauses[keyword] = strings.TrimSpace(clauses[keyword] + " " + token)
+		}
+	}
+	from, ok := clauses["from"]
+	if !ok {
+		if _, ok := clauses["by"]; !ok {
+			return hop, fmt.Errorf("invalid Received header %q", value)
+		}
+	}
+	hop.By = firstWord(clauses["by"])
+	hop.With = firstWord(clauses["with"])
+
+	// from helo (rdns [ip]), from rdns ([ip] helo=helo) or from [ip] (helo=helo)
+	hop.Helo = strings.Trim(firstWord(from), "[]")
+	if match := receivedIPRe.FindStringSubmatch(from); match != nil {
+		hop.IP = net.ParseIP(match[1])
+	}
+	if match := receivedHeloRe.FindStringSubmatch(from); match != nil {
+		hop.Helo = strings.Trim(match[1], "[]")
+	}
+	if start := strings.Index(from, "("); start >= 0 {
+		comment := strings.TrimLeft(from[start+1:], " ")
+		name := strings.TrimSuffix(firstWord(comment), ".")
+		if name != "" && !strings.HasPrefix(name, "[") && !strings.Contains(name, "=") &&
+			!strings.EqualFold(name, "unknown") && strings.Contains(name, ".") {
+			hop.ReverseDNS = strings.ToLower(strings.TrimRight(name, ")"))
+		}
+	}
+	return hop, nil
+}
+
+// parseReceivedDate parses the date of a Received header, ignoring the
+// trailing comments some servers add.
+func parseReceivedDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	date, err := mail.ParseDate(value)
+	if err != nil {
+		if i := strings.Index(value, "("); i > 0 {
+			return mail.ParseDate(strings.TrimSpace(value[:i]))
+		}
+	}
+	return date, err
+}
+
+func firstWord(s string) string {
+	word, _, _ := strings.Cut(strings.TrimSpace(s), " ")
+	return word
+}
+
+// GetReceivedChain returns the relays of the message, most recent first. The
+// Received headers that cannot be parsed are skipped.
+func (m *Email) GetReceivedChain() []Hop {
+	var chain []Hop
+	for _, value := range m.msg.Header["Received"] {
+		if hop, err := ParseReceived(value); err == nil {
+			chain = append(chain, hop)
+		}
+	}
+	return chain
+}
+
+// TrustedRelays are our own mail servers, given as IPs, CIDRs and reverse DNS
+// names (also "*.example.com"). Loopback and private addresses are always
+// trusted.
+//
+// Names are matched against the reverse DNS recorded by the receiving server,
+// which anybody controlling the reverse zone of their IP can set. They are
+// only safe when our receiving servers record forward-confirmed reverse DNS
+// names only; otherwise use IPs and CIDRs.
+type TrustedRelays struct {
+	networks []*net.IPNet
+	hosts    []string
+}
+
+// ParseTrustedRelays parses the trusted relay entries.
+func ParseTrustedRelays(entries []string) (*TrustedRelays, error) {
+	relays := &TrustedRelays{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			relays.networks = append(relays.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			relays.networks = append(relays.networks, network)
+			continue
+		}
+		if entry == "" || strings.ContainsAny(entry, "/: ") {
+			return nil, fmt.Errorf("invalid trusted relay %q", entry)
+		}
+		relays.hosts = append(relays.hosts, entry)
+	}
+	return relays, nil
+}
+
+// Trusted returns true if the hop was sent by one of our relays.
+func (r *TrustedRelays) Trusted(hop Hop) bool {
+	if hop.IP != nil && (hop.IP.IsLoopback() || hop.IP.IsPrivate()) {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+	for _, network := range r.networks {
+		if hop.IP != nil && network.Contains(hop.IP) {
+			return true
+		}
+	}
+	if hop.ReverseDNS != "" {
+		for _, host := range r.hosts {
+			if matchDomain(NormalizeDomain(hop.ReverseDNS), host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// receivedWalkEnd walks chain down from our servers and returns the index of
+// the hop that ends the walk: the first one sent from an untrusted address or
+// from a host without a recorded IP. It returns len(chain) if every hop is
+// trusted.
+func receivedWalkEnd(chain []Hop, trusted *TrustedRelays) int {
+	for i, hop := range chain {
+		if hop.IP == nil && hop.Helo == "" {
+			// Without a from clause the message was picked up locally by
+			// the receiving server, e.g. after a content filter.
+			continue
+		}
+		if hop.IP == nil || !trusted.Trusted(hop) {
+			return i
+		}
+	}
+	return len(chain)
+}
+
+// ReceivedAnalysis is the relay path of a message and its origin, the first
+// hop outside of our trusted relays.
+type ReceivedAnalysis struct {
+	Path      []Hop
+	Origin    Hop
+	HasOrigin bool
+	Flags     []string
+}
+
+// AnalyzeReceived finds the origin of a message in its chain, as returned by
+// GetReceivedChain, walking down from our servers until the first hop sent
+// from an untrusted address. A hop from a host without a recorded IP stops
+// the walk without origin, as the hops below it cannot be trusted.
+func AnalyzeReceived(chain []Hop, trusted *TrustedRelays) ReceivedAnalysis {
+	analysis := ReceivedAnalysis{Path: chain}
+	end := receivedWalkEnd(chain, trusted)
+	if end == len(chain) || chain[end].IP == nil {
+		return analysis
+	}
+	analysis.Origin = chain[end]
+	analysis.HasOrigin = true
+
+	origin := analysis.Origin
+	if origin.ReverseDNS == "" {
+		analysis.Flags = append(analysis.Flags, ReceivedNoReverseDNS)
+	} else if isResidentialName(origin.ReverseDNS, origin.IP) {
+		analysis.Flags = append(analysis.Flags, ReceivedResidential)
+	}
+	if origin.ReverseDNS != "" && origin.Helo != "" && !sameSite(origin.Helo, origin.ReverseDNS) {
+		analysis.Flags = append(analysis.Flags, ReceivedHeloMismatch)
+	}
+	return analysis
+}
+
+// isResidentialName returns true if the reverse DNS name looks like the ones
+// ISPs give to residential and dynamic addresses, with words like dsl or pool,
+// or made from the digits of the IPv4 address.
+func isResidentialName(name string, ip net.IP) bool {
+	if residentialRe.MatchString(name) {
+		return true
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	numbers := map[string]bool{}
+	for _, number := range numberRe.FindAllString(name, -1) {
+		numbers[number] = true
+	}
+	for _, octet := range ip4 {
+		if !numbers[fmt.Sprint(octet)] {
+			return false
+		}
+	}
+	return true
+}
+
+// Context returns the prompt lines describing the origin and relay path.
+func (a ReceivedAnalysis) Context() []string {
+	var context []string
+	if a.HasOrigin {
+		line := "ORIGIN: " + a.Origin.String()
+		if len(a.Flags) > 0 {
+			line += fmt.Sprintf(" [%s]", strings.Join(a.Flags, ", "))
+		}
+		context = append(context, line)
+	}
+	if len(a.Path) > 0 {
+		context = append(context, "RELAY PATH (most recent first):")
+		for i, hop := range a.Path {
+			if i == maxPromptHops {
+				context = append(context, fmt.Sprintf("- ... and %d more hops", len(a.Path)-maxPromptHops))
+				break
+			}
+			context = append(context, "- "+hop.String())
+		}
+	}
+	return context
+}
+
+// Signals returns the signals of the origin flags, e.g.
+// "received:residential".
+func (a ReceivedAnalysis) Signals() []string {
+	return flagSignals("received", a.Flags)
+}
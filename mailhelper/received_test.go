@@ -0,0 +1,153 @@
+package mailhelper
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseReceived(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  Hop
+	}{
+		{
+			name: "postfix",
+			value: "from mail.example.com (mail.example.com [192.0.2.1])\r\n\tby mx.example.org (Postfix) with ESMTPS id 4Xyz\r\n" +
+				"\tfor <user@example.org>; Tue, 10 Jun 2025 10:00:00 +0000 (UTC)",
+			want: Hop{Helo: "mail.example.com", ReverseDNS: "mail.example.com", IP: []byte{192, 0, 2, 1}, By: "mx.example.org", With: "ESMTPS",
+				Date: time.Date(2025, 6, 10, 10, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:  "unknown reverse dns",
+			value: "from bank.com (unknown [198.51.100.7]) by mx.example.org with SMTP; Tue, 10 Jun 2025 10:00:00 +0000",
+			want: Hop{Helo: "bank.com", IP: []byte{198, 51, 100, 7}, By: "mx.example.org", With: "SMTP",
+				Date: time.Date(2025, 6, 10, 10, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:  "exim",
+			value: "from [203.0.113.5] (helo=laptop) by mx.example.org with esmtpa (Exim 4.96)",
+			want:  Hop{Helo: "laptop", IP: []byte{203, 0, 113, 5}, By: "mx.example.org", With: "esmtpa"},
+		},
+		{
+			name:  "gmail with trailing dot and ipv6",
+			value: "from mail-sor-f41.google.com (mail-sor-f41.google.com. [IPv6:2001:db8::41]) by mx.google.com with SMTPS id x",
+			want:  Hop{Helo: "mail-sor-f41.google.com", ReverseDNS: "mail-sor-f41.google.com", IP: []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x41}, By: "mx.google.com", With: "SMTPS"},
+		},
+		{
+			name:  "local delivery",
+			value: "by mx.example.org (Postfix, from userid 0) id 123; Tue, 10 Jun 2025 10:00:00 +0000",
+			want:  Hop{By: "mx.example.org", Date: time.Date(2025, 6, 10, 10, 0, 0, 0, time.UTC)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop, err := ParseReceived(tt.value)
+			if err != nil {
+				t.Fatalf("ParseReceived returned error: %v", err)
+			}
+			if !hop.IP.Equal(tt.want.IP) || !hop.Date.Equal(tt.want.Date) {
+				t.Errorf("ParseReceived() = %+v, want %+v", hop, tt.want)
+			}
+			hop.IP, hop.Date, tt.want.IP, tt.want.Date = nil, time.Time{}, nil, time.Time{}
+			if !reflect.DeepEqual(hop, tt.want) {
+				t.Errorf("ParseReceived() = %+v, want %+v", hop, tt.want)
+			}
+		})
+	}
+	if _, err := ParseReceived("garbage"); err == nil {
+		t.Error("Expected error for an invalid Received header")
+	}
+}
+
+func TestAnalyzeReceived(t *testing.T) {
+	raw := "Received: by mx.example.org (Postfix, from userid 0) id 1; Tue, 10 Jun 2025 10:00:02 +0000\r\n" +
+		"Received: from relay.example.org (relay.example.org [192.0.2.10]) by mx.example.org with ESMTP; Tue, 10 Jun 2025 10:00:01 +0000\r\n" +
+		"Received: from mail.bank.com (dsl-198-51-100-7.isp.example (unverified) [198.51.100.7]) by relay.example.org with SMTP; Tue, 10 Jun 2025 10:00:00 +0000\r\n" +
+		"Received: from forged.example (forged.example [203.0.113.9]) by mail.bank.com; Tue, 10 Jun 2025 09:00:00 +0000\r\n" +
+		"From: support@bank.com\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Body"
+	email := createTestEmail(raw)
+	chain := email.GetReceivedChain()
+	if len(chain) != 4 {
+		t.Fatalf("Expected 4 hops, got %+v", chain)
+	}
+
+	trusted, err := ParseTrustedRelays([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("ParseTrustedRelays returned error: %v", err)
+	}
+	analysis := AnalyzeReceived(chain, trusted)
+	if !analysis.HasOrigin || analysis.Origin.IP.String() != "198.51.100.7" || analysis.Origin.Helo != "mail.bank.com" {
+		t.Fatalf("Unexpected origin %+v", analysis.Origin)
+	}
+	if !reflect.DeepEqual(analysis.Flags, []string{ReceivedResidential, ReceivedHeloMismatch}) {
+		t.Errorf("Unexpected flags %v", analysis.Flags)
+	}
+	if !reflect.DeepEqual(analysis.Signals(), []string{"received:residential", "received:helo_mismatch"}) {
+		t.Errorf("Unexpected signals %v", analysis.Signals())
+	}
+	context := analysis.Context()
+	if context[0] != "ORIGIN: mail.bank.com (dsl-198-51-100-7.isp.example [198.51.100.7]) to relay.example.org at 2025-06-10T10:00:00Z [RESIDENTIAL, HELO_MISMATCH]" {
+		t.Errorf("Unexpected origin line %q", context[0])
+	}
+	if len(context) != 6 || context[1] != "RELAY PATH (most recent first):" {
+		t.Errorf("Unexpected context %q", context)
+	}
+
+	// Without trusted relays the relay is the origin.
+	analysis = AnalyzeReceived(chain, nil)
+	if analysis.Origin.IP.String() != "192.0.2.10" || len(analysis.Flags) != 0 {
+		t.Errorf("Unexpected origin %+v, flags %v", analysis.Origin, analysis.Flags)
+	}
+
+	// Relays can also be trusted by name.
+	trusted, err = ParseTrustedRelays([]string{"*.example.org"})
+	if err != nil {
+		t.Fatalf("ParseTrustedRelays returned error: %v", err)
+	}
+	if analysis = AnalyzeReceived(chain, trusted); analysis.Origin.IP.String() != "198.51.100.7" {
+		t.Errorf("Unexpected origin %+v", analysis.Origin)
+	}
+
+	// A hop from a host without IP hides where the message came from, the
+	// hops below it may be forged.
+	noIP := createTestEmail("Received: from relay.example.org by mx.example.org with ESMTP; Tue, 10 Jun 2025 10:00:01 +0000\r\n" +
+		"Received: from forged.example (forged.example [203.0.113.9]) by relay.example.org; Tue, 10 Jun 2025 09:00:00 +0000\r\n" +
+		"\r\nBody")
+	if analysis = AnalyzeReceived(noIP.GetReceivedChain(), nil); analysis.HasOrigin {
+		t.Errorf("Expected no origin past a hop without IP, got %+v", analysis.Origin)
+	}
+}
+
+func TestParseTrustedRelays(t *testing.T) {
+	trusted, err := ParseTrustedRelays([]string{"192.0.2.1", "2001:db8::/32", "mx.example.org"})
+	if err != nil {
+		t.Fatalf("ParseTrustedRelays returned error: %v", err)
+	}
+	tests := []struct {
+		hop  Hop
+		want bool
+	}{
+		{hop: Hop{IP: []byte{192, 0, 2, 1}}, want: true},
+		{hop: Hop{IP: []byte{192, 0, 2, 2}}},
+		{hop: Hop{IP: []byte{10, 0, 0, 1}}, want: true},
+		{hop: Hop{IP: []byte{127, 0, 0, 1}}, want: true},
+		{hop: Hop{IP: []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}}, want: true},
+		{hop: Hop{IP: []byte{198, 51, 100, 1}, ReverseDNS: "MX.example.org"}, want: true},
+		{hop: Hop{IP: []byte{198, 51, 100, 1}, Helo: "mx.example.org"}},
+	}
+	for _, tt := range tests {
+		if got := trusted.Trusted(tt.hop); got != tt.want {
+			t.Errorf("Trusted(%+v) = %v, want %v", tt.hop, got, tt.want)
+		}
+	}
+	for _, entry := range []string{"", "192.0.2.0/33", "mx example"} {
+		if _, err := ParseTrustedRelays([]string{entry}); err == nil {
+			t.Errorf("Expected error for %q", entry)
+		}
+	}
+}
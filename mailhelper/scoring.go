@@ -0,0 +1,72 @@
+package mailhelper
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// PolicyLLM decides only with the LLM score. It is the default.
+	PolicyLLM = "llm"
+	// PolicyWeighted decides with the weighted sum of the upstream and LLM scores.
+	PolicyWeighted = "weighted"
+	// PolicyEither considers spam anything over the threshold of either score.
+	PolicyEither = "either"
+)
+
+// ScoringPolicy blends the score of the upstream filter (e.g. SpamAssassin)
+// with the LLM score. The upstream score is rescaled so UpstreamThreshold
+// matches the rule threshold before combining both.
+type ScoringPolicy struct {
+	Policy            string   `yaml:"policy"`
+	UpstreamWeight    float64  `yaml:"upstream_weight"`
+	LLMWeight         float64  `yaml:"llm_weight"`
+	UpstreamThreshold float64  `yaml:"upstream_threshold"`
+	SkipHamBelow      *float64 `yaml:"skip_ham_below"`
+	SkipSpamAbove     *float64 `yaml:"skip_spam_above"`
+}
+
+// Validate checks the policy name and weights.
+func (p ScoringPolicy) Validate() error {
+	switch p.Policy {
+	case "", PolicyLLM, PolicyEither:
+		return nil
+	case PolicyWeighted:
+		if p.UpstreamWeight < 0 || p.LLMWeight < 0 || p.UpstreamWeight+p.LLMWeight == 0 {
+			return fmt.Errorf("weighted policy needs non-negative weights with a positive sum")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown scoring policy %q", p.Policy)
+	}
+}
+
+// Skip returns a verdict without asking the LLM when the upstream score is
+// confidently ham or spam. The returned score is 0 for ham and 10 for spam.
+func (p ScoringPolicy) Skip(upstream float64) (float64, string, bool) {
+	if p.SkipHamBelow != nil && upstream <= *p.SkipHamBelow {
+		return 0, fmt.Sprintf("Upstream filter score %.2f is confidently not spam", upstream), true
+	}
+	if p.SkipSpamAbove != nil && upstream >= *p.SkipSpamAbove {
+		return 10, fmt.Sprintf("Upstream filter score %.2f is confidently spam", upstream), true
+	}
+	return 0, "", false
+}
+
+// Combine returns the final score of a message to be compared with threshold.
+func (p ScoringPolicy) Combine(upstream float64, llmScore float64, threshold float64) float64 {
+	upstreamThreshold := p.UpstreamThreshold
+	if upstreamThreshold <= 0 {
+		upstreamThreshold = 5
+	}
+	rescaled := math.Max(0, math.Min(10, upstream/upstreamThreshold*threshold))
+
+	switch p.Policy {
+	case PolicyWeighted:
+		return (p.UpstreamWeight*rescaled + p.LLMWeight*llmScore) / (p.UpstreamWeight + p.LLMWeight)
+	case PolicyEither:
+		return math.Max(rescaled, llmScore)
+	default:
+		return llmScore
+	}
+}
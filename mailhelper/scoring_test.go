@@ -0,0 +1,100 @@
+package mailhelper
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScoringPolicyCombine(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    ScoringPolicy
+		upstream  float64
+		llmScore  float64
+		threshold float64
+		want      float64
+	}{
+		{
+			name:      "default policy uses only the LLM",
+			policy:    ScoringPolicy{},
+			upstream:  20,
+			llmScore:  2,
+			threshold: 5,
+			want:      2,
+		},
+		{
+			name:      "weighted sum rescales the upstream score",
+			policy:    ScoringPolicy{Policy: PolicyWeighted, UpstreamWeight: 1, LLMWeight: 1, UpstreamThreshold: 5},
+			upstream:  2.5,
+			llmScore:  8,
+			threshold: 6,
+			want:      5.5,
+		},
+		{
+			name:      "either takes the upstream score when over its threshold",
+			policy:    ScoringPolicy{Policy: PolicyEither, UpstreamThreshold: 4},
+			upstream:  6,
+			llmScore:  1,
+			threshold: 5,
+			want:      7.5,
+		},
+		{
+			name:      "either takes the LLM score when higher",
+			policy:    ScoringPolicy{Policy: PolicyEither},
+			upstream:  -3,
+			llmScore:  9,
+			threshold: 5,
+			want:      9,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Combine(tt.upstream, tt.llmScore, tt.threshold)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Combine() = %f, want %f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScoringPolicySkip(t *testing.T) {
+	ham, spam := -1.0, 10.0
+	policy := ScoringPolicy{SkipHamBelow: &ham, SkipSpamAbove: &spam}
+
+	if score, _, skip := policy.Skip(-2); !skip || score != 0 {
+		t.Errorf("Expected confident ham to skip with score 0, got %v %f", skip, score)
+	}
+	if score, _, skip := policy.Skip(11); !skip || score != 10 {
+		t.Errorf("Expected confident spam to skip with score 10, got %v %f", skip, score)
+	}
+	if _, _, skip := policy.Skip(3); skip {
+		t.Errorf("Expected uncertain score not to skip")
+	}
+	if _, _, skip := (ScoringPolicy{}).Skip(100); skip {
+		t.Errorf("Expected default policy never to skip")
+	}
+}
+
+func TestScoringPolicyValidate(t *testing.T) {
+	valid := []ScoringPolicy{
+		{},
+		{Policy: PolicyLLM},
+		{Policy: PolicyEither},
+		{Policy: PolicyWeighted, UpstreamWeight: 0.3, LLMWeight: 0.7},
+	}
+	for _, p := range valid {
+		if err := p.Validate(); err != nil {
+			t.Errorf("Validate(%+v) returned error: %v", p, err)
+		}
+	}
+	invalid := []ScoringPolicy{
+		{Policy: "unknown"},
+		{Policy: PolicyWeighted},
+		{Policy: PolicyWeighted, UpstreamWeight: -1, LLMWeight: 2},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Validate(%+v) expected error", p)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package mailhelper
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Fields a sender list entry can match, selected with a "field:" prefix.
+// Entries without prefix match the sender address.
+const (
+	fieldFrom       = "from"
+	fieldName       = "name"
+	fieldReplyTo    = "reply-to"
+	fieldReturnPath = "return-path"
+	fieldListID     = "list-id"
+	fieldHeader     = "header"
+)
+
+// senderEntry is a parsed sender list entry.
+type senderEntry struct {
+	raw    string
+	negate bool
+	field  string
+	header string
+	value  string
+	re     *regexp.Regexp
+}
+
+// SenderList matches messages against whitelist or blocklist entries:
+//
+//	john@example.com, example.com, *@example.com, *.example.com
+//	re:^billing-\d+@example\.com$        regular expression on the address
+//	name:PayPal, name:re:pay ?pal        sender display name
+//	reply-to:example.com                 any Reply-To address
+//	return-path:bounces.example.com      envelope sender
+//	list-id:*.lists.example.com          mailing list
+//	header:X-Mailer=^PHPMailer           regular expression on any header
+//	!noreply+phish@github.com            negation
+//
+// A message matches when a plain entry matches and no negated entry does.
+// Regular expressions are case insensitive.
+//
+// Only the sender address can be authenticated, the other fields are written
+// by the sender at will, so whitelists accept them in negated entries only
+// (see ValidateWhitelist).
+//
+// Plain addresses and domains, the bulk of big lists, are indexed in maps;
+// only the other entries are checked one by one.
+type SenderList struct {
+	entries []senderEntry
+	// linear are the positions of the entries that are not indexed.
+	linear    []int
+	addresses map[string]int
+	domains   map[string]int
+	suffixes  map[string]int
+}
+
+// ParseSenderList parses the entries of a sender list.
+func ParseSenderList(entries []string) (*SenderList, error) {
+	list := &SenderList{
+		addresses: map[string]int{},
+		domains:   map[string]int{},
+		suffixes:  map[string]int{},
+	}
+	for i, raw := range entries {
+		entry, err := parseSenderEntry(raw)
+		if err != nil {
+			return nil, err
+		}
+		list.entries = append(list.entries, entry)
+		list.index(i, entry)
+	}
+	return list, nil
+}
+
+// ValidateWhitelist returns an error for the entries that cannot whitelist
+// messages safely: the ones matching the display name, Reply-To,
+// Return-Path, List-Id or any header, which an attacker can set to anything
+// from an authenticated throwaway domain. They are fine in a blocklist and as
+// negated entries.
+func (l *SenderList) ValidateWhitelist() error {
+	for _, entry := range l.entries {
+		if !entry.negate && entry.field != fieldFrom {
+			return fmt.Errorf("invalid whitelist entry %q: %s: entries can only be used in the blocklist or negated", entry.raw, entry.field)
+		}
+	}
+	return nil
+}
+
+// index adds plain address and domain entries to the maps, keeping the first
+// position of repeated ones.
+func (l *SenderList) index(i int, entry senderEntry) {
+	if entry.negate || entry.field != fieldFrom || entry.re != nil {
+		l.linear = append(l.linear, i)
+		return
+	}
+	value := strings.TrimPrefix(entry.value, "*@")
+	index := l.domains
+	if local, domain, ok := strings.Cut(value, "@"); ok {
+		index = l.addresses
+		value = strings.ToLower(local) + "@" + NormalizeDomain(domain)
+	} else if base, ok := strings.CutPrefix(value, "*."); ok {
+		index = l.suffixes
+		value = NormalizeDomain(base)
+	} else {
+		value = NormalizeDomain(value)
+	}
+	if _, ok := index[value]; !ok {
+		index[value] = i
+	}
+}
+
+// lookup returns the position of the first indexed entry matching address,
+// or -1.
+func (l *SenderList) lookup(address string) int {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok || strings.Contains(domain, "@") {
+		return -1 // invalid email address format
+	}
+	domain = NormalizeDomain(domain)
+	address = strings.ToLower(local) + "@" + domain
+	best := -1
+	update := func(index map[string]int, key string) {
+		if i, ok := index[key]; ok && (best < 0 || i < best) {
+			best = i
+		}
+	}
+	update(l.addresses, address)
+	update(l.domains, domain)
+	// *.example.com matches the subdomains of example.com, not itself.
+	for parent := domain; ; {
+		dot := strings.Index(parent, ".")
+		if dot < 0 {
+			break
+		}
+		parent = parent[dot+1:]
+		update(l.suffixes, parent)
+	}
+	return best
+}
+
+func parseSenderEntry(raw string) (senderEntry, error) {
+	entry := senderEntry{raw: raw, field: fieldFrom}
+	value := strings.TrimSpace(raw)
+	if strings.HasPrefix(value, "!") {
+		entry.negate = true
+		value = strings.TrimSpace(value[1:])
+	}
+	if field, rest, ok := strings.Cut(value, ":"); ok {
+		switch strings.ToLower(field) {
+		case fieldFrom, fieldName, fieldReplyTo, fieldReturnPath, fieldListID:
+			entry.field = strings.ToLower(field)
+			value = rest
+		case fieldHeader:
+			name, pattern, ok := strings.Cut(rest, "=")
+			if !ok || name == "" {
+				return entry, fmt.Errorf("invalid entry %q: expected header:Name=regex", raw)
+			}
+			entry.field = fieldHeader
+			entry.header = name
+			value = "re:" + pattern
+		}
+	}
+	if pattern, ok := strings.CutPrefix(value, "re:"); ok {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return entry, fmt.Errorf("invalid entry %q: %v", raw, err)
+		}
+		entry.re = re
+	}
+	if value == "" {
+		return entry, fmt.Errorf("invalid empty entry %q", raw)
+	}
+	entry.value = value
+	return entry, nil
+}
+
+// matchValue matches a single value of the entry field.
+func (e senderEntry) matchValue(value string) bool {
+	if e.re != nil {
+		return e.re.MatchString(value)
+	}
+	switch e.field {
+	case fieldName:
+		return strings.EqualFold(value, e.value)
+	case fieldListID:
+		value = NormalizeDomain(value)
+		if base, ok := strings.CutPrefix(e.value, "*."); ok {
+			return strings.HasSuffix(value, "."+NormalizeDomain(base))
+		}
+		return value == NormalizeDomain(e.value)
+	}
+	return matchAddress(value, e.value)
+}
+
+// values returns the values of the entry field in the email.
+func (e senderEntry) values(email *Email, sender *mail.Address) []string {
+	switch e.field {
+	case fieldFrom:
+		return []string{sender.Address}
+	case fieldName:
+		return []string{sender.Name}
+	case fieldReplyTo:
+		addresses, err := email.GetAddressList("Reply-To")
+		if err != nil {
+			return nil
+		}
+		values := make([]string, 0, len(addresses))
+		for _, address := range addresses {
+			values = append(values, address.Address)
+		}
+		return values
+	case fieldReturnPath:
+		value := strings.Trim(strings.TrimSpace(email.GetHeader("Return-Path")), "<>")
+		if value == "" {
+			return nil
+		}
+		return []string{value}
+	case fieldListID:
+		// List-Id: Announcements <announce.lists.example.com>
+		value := email.GetDecodedHeader("List-Id")
+		if start, end := strings.LastIndex(value, "<"), strings.LastIndex(value, ">"); start >= 0 && end > start {
+			value = value[start+1 : end]
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return nil
+		}
+		return []string{value}
+	case fieldHeader:
+		return []string{email.GetDecodedHeader(e.header)}
+	}
+	return nil
+}
+
+func (e senderEntry) match(email *Email, sender *mail.Address) bool {
+	for _, value := range e.values(email, sender) {
+		if e.matchValue(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the first plain entry matching the email sent by sender,
+// unless a negated entry matches too.
+func (l *SenderList) Match(email *Email, sender *mail.Address) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	best := l.lookup(sender.Address)
+	for _, i := range l.linear {
+		entry := l.entries[i]
+		// Negations always apply, other entries only if they come first.
+		if !entry.negate && best >= 0 && i > best {
+			continue
+		}
+		if !entry.match(email, sender) {
+			continue
+		}
+		if entry.negate {
+			return "", false
+		}
+		best = i
+	}
+	if best < 0 {
+		return "", false
+	}
+	return l.entries[best].raw, true
+}
+
+// Domains returns the domains of the plain address and domain entries, the
+// ones a lookalike sender could imitate.
+func (l *SenderList) Domains() []string {
+	if l == nil {
+		return nil
+	}
+	var domains []string
+	for _, index := range []map[string]int{l.domains, l.suffixes} {
+		for domain := range index {
+			domains = append(domains, domain)
+		}
+	}
+	for address := range l.addresses {
+		domains = append(domains, address[strings.Index(address, "@")+1:])
+	}
+	return domains
+}
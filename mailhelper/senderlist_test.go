@@ -0,0 +1,92 @@
+package mailhelper
+
+import "testing"
+
+func TestSenderListMatch(t *testing.T) {
+	raw := "From: \"GitHub\" <NoReply+Phish@github.com>\r\n" +
+		"Reply-To: help@support.example.net, other@example.org\r\n" +
+		"Return-Path: <bounces@mail.github.com>\r\n" +
+		"List-Id: Announcements <announce.lists.example.com>\r\n" +
+		"X-Mailer: PHPMailer 6.0\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Body"
+	email := createTestEmail(raw)
+	sender, err := email.GetSender()
+	if err != nil {
+		t.Fatalf("GetSender returned error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		entries []string
+		entry   string
+		want    bool
+	}{
+		{name: "domain", entries: []string{"github.com"}, entry: "github.com", want: true},
+		{name: "any address of domain", entries: []string{"*@github.com"}, entry: "*@github.com", want: true},
+		{name: "address is case insensitive", entries: []string{"noreply+phish@GitHub.com"}, entry: "noreply+phish@GitHub.com", want: true},
+		{name: "negation", entries: []string{"*@github.com", "!noreply+phish@github.com"}},
+		{name: "negation of another address", entries: []string{"*@github.com", "!security@github.com"}, entry: "*@github.com", want: true},
+		{name: "regex", entries: []string{`re:^noreply\+\w+@github\.com$`}, entry: `re:^noreply\+\w+@github\.com$`, want: true},
+		{name: "regex no match", entries: []string{`re:^billing@`}},
+		{name: "display name", entries: []string{"name:github"}, entry: "name:github", want: true},
+		{name: "display name regex", entries: []string{"name:re:^git"}, entry: "name:re:^git", want: true},
+		{name: "reply-to", entries: []string{"reply-to:example.org"}, entry: "reply-to:example.org", want: true},
+		{name: "reply-to wildcard", entries: []string{"reply-to:*.example.net"}, entry: "reply-to:*.example.net", want: true},
+		{name: "return-path", entries: []string{"return-path:mail.github.com"}, entry: "return-path:mail.github.com", want: true},
+		{name: "list-id", entries: []string{"list-id:*.lists.example.com"}, entry: "list-id:*.lists.example.com", want: true},
+		{name: "list-id exact", entries: []string{"list-id:lists.example.com"}},
+		{name: "header", entries: []string{"header:X-Mailer=^phpmailer"}, entry: "header:X-Mailer=^phpmailer", want: true},
+		{name: "missing header", entries: []string{"header:X-Campaign=.+"}},
+		{name: "negated header", entries: []string{"github.com", "!header:X-Mailer=PHPMailer"}},
+		{name: "first entry wins", entries: []string{"hotmail.com", "name:GitHub", "github.com"}, entry: "name:GitHub", want: true},
+		{name: "first indexed entry wins", entries: []string{"noreply+phish@github.com", "*.com", "name:GitHub"}, entry: "noreply+phish@github.com", want: true},
+		{name: "wildcard before domain", entries: []string{"*.com", "github.com"}, entry: "*.com", want: true},
+		{name: "wildcard does not match the domain itself", entries: []string{"*.github.com"}},
+		{name: "negation after indexed entry", entries: []string{"github.com", "!name:GitHub"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := ParseSenderList(tt.entries)
+			if err != nil {
+				t.Fatalf("ParseSenderList returned error: %v", err)
+			}
+			entry, ok := list.Match(email, sender)
+			if ok != tt.want || entry != tt.entry {
+				t.Errorf("Match() = %q, %v, want %q, %v", entry, ok, tt.entry, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSenderListErrors(t *testing.T) {
+	for _, entry := range []string{"", "!", "re:(", "header:X-Mailer", "header:=x", "name:"} {
+		if _, err := ParseSenderList([]string{entry}); err == nil {
+			t.Errorf("Expected error for entry %q", entry)
+		}
+	}
+}
+
+func TestValidateWhitelist(t *testing.T) {
+	valid := []string{"github.com", "*@github.com", `re:^billing@`, "!name:GitHub", "!header:X-Mailer=PHPMailer"}
+	list, err := ParseSenderList(valid)
+	if err != nil {
+		t.Fatalf("ParseSenderList returned error: %v", err)
+	}
+	if err := list.ValidateWhitelist(); err != nil {
+		t.Errorf("ValidateWhitelist returned error: %v", err)
+	}
+	for _, entry := range []string{"name:GitHub", "reply-to:example.org", "return-path:github.com", "list-id:lists.example.com", "header:X-Mailer=^Internal"} {
+		list, err := ParseSenderList([]string{entry})
+		if err != nil {
+			t.Fatalf("ParseSenderList returned error: %v", err)
+		}
+		if err := list.ValidateWhitelist(); err == nil {
+			t.Errorf("Expected error for whitelist entry %q", entry)
+		}
+	}
+	if _, err := NewWhitelistSource([]string{"name:GitHub"}); err == nil {
+		t.Errorf("Expected NewWhitelistSource to refuse a display name entry")
+	}
+}
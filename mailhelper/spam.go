@@ -1,10 +1,18 @@
 package mailhelper
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/mail"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/tmc/langchaingo/embeddings"
 	"github.com/tmc/langchaingo/llms"
 
 	"llm-antispam/llm"
@@ -13,6 +21,7 @@ import (
 
 type llmResult struct {
 	id         uint32
+	uid        uint32
 	score      float64
 	reason     string
 	err        error
@@ -21,6 +30,359 @@ type llmResult struct {
 	sender     string
 }
 
+// maxPromptLinks is the maximum number of links summarized in the prompt.
+const maxPromptLinks = 20
+
+// Option configures optional behaviour of ClassifySpam.
+type Option func(*classifyOptions)
+
+type classifyOptions struct {
+	cache          *VerdictCache
+	cacheModel     string
+	maxTokens      int
+	countTokens    func(string) int
+	ledger         *llm.UsageLedger
+	account        string
+	rule           string
+	provider       string
+	model          string
+	scoring        ScoringPolicy
+	upstreamCtx    bool
+	upstreamList   []string
+	upstreamRelays *TrustedRelays
+	conditions     []Condition
+	authServIDs    []string
+	authWhitelist  bool
+	dkimResolver   TXTResolver
+
+	whitelist      *ListSource
+	contacts       *ContactBook
+	lookalike      bool
+	headerFeatures []string
+	featureRelays  *TrustedRelays
+	received       bool
+	trustedRelays  *TrustedRelays
+	brands         []string
+	blocklist      *ListSource
+	blocklistScore float64
+	dnsbl          *DNSBLChecker
+	dnsblRelays    *TrustedRelays
+	bayes          *BayesModel
+	bayesHamBelow  float64
+	bayesSpamAbove float64
+	embedder       embeddings.Embedder
+	vectors        *VectorStore
+	knn            KNNPolicy
+
+	attachmentTextSize   int64
+	attachmentTextTokens int
+	attachmentTextCount  func(string) int
+}
+
+// WithCache reuses verdicts from cache for messages already classified by model.
+func WithCache(cache *VerdictCache, model string) Option {
+	return func(o *classifyOptions) {
+		o.cache = cache
+		o.cacheModel = model
+	}
+}
+
+// WithTokenBudget truncates email bodies longer than maxTokens, as measured by
+// countTokens, before sending them to the LLM.
+func WithTokenBudget(maxTokens int, countTokens func(string) int) Option {
+	return func(o *classifyOptions) {
+		o.maxTokens = maxTokens
+		o.countTokens = countTokens
+	}
+}
+
+// WithUsageLedger records the token usage of every LLM call in ledger under the
+// given account, rule and model. Paid providers are not called once the daily
+// budget of the ledger is spent, the messages are left for the next run.
+func WithUsageLedger(ledger *llm.UsageLedger, account string, rule string, provider string, model string) Option {
+	return func(o *classifyOptions) {
+		o.ledger = ledger
+		o.account = account
+		o.rule = rule
+		o.provider = provider
+		o.model = model
+	}
+}
+
+// WithScoringPolicy combines the upstream filter score with the LLM score
+// according to policy, skipping the LLM when the upstream score is conclusive.
+func WithScoringPolicy(policy ScoringPolicy) Option {
+	return func(o *classifyOptions) {
+		o.scoring = policy
+	}
+}
+
+// WithUpstreamContext adds the verdict and symbols of the upstream filters to
+// the email sent to the LLM.
+func WithUpstreamContext() Option {
+	return func(o *classifyOptions) {
+		o.upstreamCtx = true
+	}
+}
+
+// WithUpstreamFilters trusts the verdicts of the named upstream filters, in
+// this order of priority, as written by our servers: the hops of the trusted
+// relays. No upstream verdict is used without it.
+func WithUpstreamFilters(names []string, trusted *TrustedRelays) Option {
+	return func(o *classifyOptions) {
+		o.upstreamList = names
+		o.upstreamRelays = trusted
+	}
+}
+
+// WithConditions forces the score of the messages raising one of the signals
+// of conditions.
+func WithConditions(conditions []Condition) Option {
+	return func(o *classifyOptions) {
+		o.conditions = conditions
+	}
+}
+
+// WithAuthServIDs trusts the Authentication-Results added by the given
+// authserv-ids, adding them to the prompt and to the signals of conditions.
+func WithAuthServIDs(ids []string) Option {
+	return func(o *classifyOptions) {
+		o.authServIDs = ids
+	}
+}
+
+// WithAuthenticatedWhitelist only skips whitelisted senders when they are
+// authenticated by DMARC or an aligned DKIM signature. The others are
+// classified as usual and flagged as possible spoofing.
+func WithAuthenticatedWhitelist() Option {
+	return func(o *classifyOptions) {
+		o.authWhitelist = true
+	}
+}
+
+// WithDKIMVerification verifies the DKIM signatures of every message, looking
+// up the keys with resolver. Valid signatures authenticate whitelisted senders
+// and are added to the prompt.
+func WithDKIMVerification(resolver TXTResolver) Option {
+	return func(o *classifyOptions) {
+		o.dkimResolver = resolver
+	}
+}
+
+// WithWhitelist matches the senders against the (reloading) list of source
+// instead of the whitelisted domains.
+func WithWhitelist(source *ListSource) Option {
+	return func(o *classifyOptions) {
+		o.whitelist = source
+	}
+}
+
+// WithContacts whitelists the addresses of book, the people we have written
+// to.
+func WithContacts(book *ContactBook) Option {
+	return func(o *classifyOptions) {
+		o.contacts = book
+	}
+}
+
+// WithLookalikeDetection flags senders whose domain is confusable with a
+// whitelisted domain or one of brands, raising the sender:lookalike signal and
+// warning the LLM.
+func WithLookalikeDetection(brands []string) Option {
+	return func(o *classifyOptions) {
+		o.lookalike = true
+		o.brands = brands
+	}
+}
+
+// WithHeaderFeatures adds the given header features (see HeaderFeatures) to
+// the prompt and their signals to the conditions. The trusted relays are
+// skipped to find the first external hop.
+func WithHeaderFeatures(features []string, trusted *TrustedRelays) Option {
+	return func(o *classifyOptions) {
+		o.headerFeatures = features
+		o.featureRelays = trusted
+	}
+}
+
+// WithReceivedAnalysis adds the origin and relay path of the messages to the
+// prompt and the origin flags to the signals, trusting the relays of trusted.
+func WithReceivedAnalysis(trusted *TrustedRelays) Option {
+	return func(o *classifyOptions) {
+		o.received = true
+		o.trustedRelays = trusted
+	}
+}
+
+// WithBlocklist gives score to the messages from senders matching the list of
+// source, without asking the LLM.
+func WithBlocklist(source *ListSource, score float64) Option {
+	return func(o *classifyOptions) {
+		o.blocklist = source
+		o.blocklistScore = score
+	}
+}
+
+// WithDNSBL looks up the origin IP of the messages, the first hop outside of
+// the trusted relays, and the domains of their links with checker, adding the
+// listings to the prompt and the signals.
+func WithDNSBL(checker *DNSBLChecker, trusted *TrustedRelays) Option {
+	return func(o *classifyOptions) {
+		o.dnsbl = checker
+		o.dnsblRelays = trusted
+	}
+}
+
+// WithBayesFilter classifies locally with model the messages whose spam
+// probability is at most hamBelow or at least spamAbove, and only asks the
+// LLM about the uncertain ones.
+func WithBayesFilter(model *BayesModel, hamBelow float64, spamAbove float64) Option {
+	return func(o *classifyOptions) {
+		o.bayes = model
+		o.bayesHamBelow = hamBelow
+		o.bayesSpamAbove = spamAbove
+	}
+}
+
+// WithKNNClassifier scores the messages by their similarity, as embedded by
+// embedder, to the known spam and ham of store, alone or combined with the
+// LLM score as set by policy.
+func WithKNNClassifier(embedder embeddings.Embedder, store *VectorStore, policy KNNPolicy) Option {
+	return func(o *classifyOptions) {
+		o.embedder = embedder
+		o.vectors = store
+		o.knn = policy
+	}
+}
+
+// WithAttachmentText appends the text of PDF, DOCX and HTML attachments of up
+// to maxSize bytes to the body, truncated to maxTokens in total as measured by
+// countTokens.
+func WithAttachmentText(maxSize int64, maxTokens int, countTokens func(string) int) Option {
+	return func(o *classifyOptions) {
+		o.attachmentTextSize = maxSize
+		o.attachmentTextTokens = maxTokens
+		o.attachmentTextCount = countTokens
+	}
+}
+
+// appendAttachmentText appends the text of the attachments to body as labeled
+// sections sharing a budget of maxTokens.
+func appendAttachmentText(body string, attachments []Attachment, maxTokens int, countTokens func(string) int) string {
+	var builder strings.Builder
+	builder.WriteString(body)
+	remaining := maxTokens
+	for _, attachment := range attachments {
+		if attachment.Text == "" || remaining <= 0 {
+			continue
+		}
+		text, _ := TruncateBody(attachment.Text, remaining, countTokens)
+		remaining -= countTokens(text)
+		fmt.Fprintf(&builder, "\n\n--- Text of attachment %q ---\n%s", attachment.Filename, text)
+	}
+	return builder.String()
+}
+
+// formatAddress formats an address without re-encoding the display name as
+// mail.Address.String does, so humans and the LLM can read it.
+func formatAddress(address *mail.Address) string {
+	if address.Name == "" {
+		return "<" + address.Address + ">"
+	}
+	return fmt.Sprintf("%s <%s>", address.Name, address.Address)
+}
+
+// formatEmail builds the text sent to the LLM with the main headers, any
+// extra context lines and the cleaned body.
+func formatEmail(sender *mail.Address, subject string, context []string, body string) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "FROM: %s\nSUBJECT: %s\n", formatAddress(sender), subject)
+	for _, line := range context {
+		builder.WriteString(line)
+		builder.WriteString("\n")
+	}
+	builder.WriteString("\n")
+	builder.WriteString(body)
+	return builder.String()
+}
+
+// cacheText returns the text the verdict cache key of a message is built
+// from: its sender, subject, body and stable signals. The context lines that
+// change with every delivery, like the relay times, the date skew or the DNSBL
+// listings of the origin, are left out so the same campaign shares the key.
+func cacheText(sender *mail.Address, subject string, signals []string, body string) string {
+	stable := append([]string(nil), signals...)
+	sort.Strings(stable)
+	stable = slices.Compact(stable)
+	return formatEmail(sender, subject, []string{"SIGNALS: " + strings.Join(stable, ", ")}, body)
+}
+
+// classify sends the cleaned email to the LLM, going through the verdict cache
+// when one is configured. The cache key is built from keyText.
+func (o *classifyOptions) classify(llmClassifier llms.Model, cleanedMail string, keyText string) (float64, string, error) {
+	var key string
+	if o.cache != nil {
+		key = CacheKey(o.cacheModel, keyText)
+		if verdict, ok := o.cache.Get(key); ok {
+			return verdict.Score, verdict.Reason + " (cached)", nil
+		}
+	}
+	if o.ledger != nil && llm.IsPaidProvider(o.provider) && o.ledger.BudgetExceeded(time.Now()) {
+		return 0, "", llm.ErrBudgetExceeded
+	}
+	score, reason, usage, err := llm.ClassifyEmailWithUsage(llmClassifier, cleanedMail)
+	if o.ledger != nil {
+		o.ledger.Record(o.account, o.rule, o.model, usage)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if o.cache != nil {
+		o.cache.Put(key, score, reason)
+	}
+	return score, reason, nil
+}
+
+// errNoNeighbours is returned by the k-NN classifier when no known message is
+// similar enough to the email.
+var errNoNeighbours = errors.New("no known message is similar enough to the email")
+
+// classifyKNN scores the message embedded from text with its nearest known
+// messages.
+func (o *classifyOptions) classifyKNN(text string) (float64, string, error) {
+	vector, err := o.embedder.EmbedQuery(context.Background(), text)
+	if err != nil {
+		return 0, "", fmt.Errorf("error embedding email: %w", err)
+	}
+	score, reason, ok := o.vectors.Score(vector, o.knn.K, o.knn.MinSimilarity)
+	if !ok {
+		return 0, "", errNoNeighbours
+	}
+	return score, reason, nil
+}
+
+// classifyMessage classifies a message with the LLM, the k-NN classifier or
+// both, depending on the k-NN policy. The LLM score is used alone if the k-NN
+// classifier fails in combined mode, or finds no similar known message.
+func (o *classifyOptions) classifyMessage(llmClassifier llms.Model, cleanedMail string, keyText string, embeddingText string) (float64, string, error) {
+	if o.embedder == nil {
+		return o.classify(llmClassifier, cleanedMail, keyText)
+	}
+	knnScore, knnReason, knnErr := o.classifyKNN(embeddingText)
+	if o.knn.Mode == KNNAlone && !errors.Is(knnErr, errNoNeighbours) {
+		return knnScore, "k-NN: " + knnReason, knnErr
+	}
+	score, reason, err := o.classify(llmClassifier, cleanedMail, keyText)
+	if err != nil {
+		return 0, "", err
+	}
+	if knnErr != nil {
+		log.Printf("Error in the k-NN classifier, using the LLM score only: %v", knnErr)
+		return score, reason, nil
+	}
+	return (1-o.knn.Weight)*score + o.knn.Weight*knnScore, reason + ". k-NN: " + knnReason, nil
+}
+
 func ClassifySpam(
 	messages <-chan *imap.Message,
 	ids []uint32,
@@ -29,7 +391,33 @@ func ClassifySpam(
 	lastProcessedID uint32,
 	llmClassifier llms.Model,
 	concurrency bool,
+	opts ...Option,
 ) (*imap.SeqSet, *imap.SeqSet, uint32, error) {
+	options := &classifyOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	whitelist := options.whitelist.List()
+	if whitelist == nil {
+		var err error
+		whitelist, err = ParseSenderList(whitelisted_domains)
+		if err == nil {
+			err = whitelist.ValidateWhitelist()
+		}
+		if err != nil {
+			// Drain the messages so the fetch can finish.
+			for range messages {
+			}
+			return nil, nil, 0, fmt.Errorf("invalid whitelist: %w", err)
+		}
+	}
+	blocklist := options.blocklist.List()
+	var lookalikes *LookalikeDetector
+	if options.lookalike {
+		lookalikes = NewLookalikeDetector(append(whitelist.Domains(), options.brands...))
+	}
+
 	count := 0
 
 	spamSeqset := new(imap.SeqSet)
@@ -61,39 +449,205 @@ func ClassifySpam(
 			log.Printf("Error getting sender: %v", err)
 			continue
 		}
-		whitelisted := IsWhitelistedEmail(sender.Address, whitelisted_domains)
+		// forceVerdict records a verdict reached without asking the LLM.
+		forceVerdict := func(score float64, reason string, spamStatus float64) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				scoreChannel <- llmResult{
+					score:      score,
+					id:         id,
+					spamStatus: spamStatus,
+					reason:     reason,
+					sender:     sender.Address,
+					subject:    subject,
+				}
+			}()
+		}
+
+		if entry, blocked := blocklist.Match(email, sender); blocked {
+			forceVerdict(options.blocklistScore, fmt.Sprintf("Sender matches blocklist entry %q", entry), 0)
+			continue
+		}
+
+		authResults := email.GetAuthenticationResults(options.authServIDs)
+		signals := AuthSignals(authResults)
+		var dkimResult *DKIMResult
+		if options.dkimResolver != nil {
+			result, err := email.VerifyDKIM(options.dkimResolver)
+			if err != nil {
+				log.Printf("Error verifying DKIM signatures: %v", err)
+			} else {
+				dkimResult = &result
+				signals = append(signals, result.Signal())
+			}
+		}
+		entry, whitelisted := whitelist.Match(email, sender)
+		if !whitelisted && options.contacts.Contains(sender.Address, time.Now()) {
+			entry, whitelisted = "contact:"+sender.Address, true
+		}
+		spoofed := false
+		if whitelisted && options.authWhitelist {
+			// DMARC and DKIM alignment authenticate the From domain, not a
+			// Sender header, so both must be the same.
+			var fromDomain string
+			if from, err := email.GetAddressList("From"); err == nil && len(from) > 0 {
+				fromDomain = addressDomain(from[0].Address)
+			}
+			var dkimDomains []string
+			if dkimResult != nil {
+				dkimDomains = dkimResult.Domains
+			}
+			if fromDomain != addressDomain(sender.Address) || !IsAuthenticatedSender(fromDomain, authResults, dkimDomains) {
+				log.Printf("Possible spoofing: sender %s matches whitelist entry %q but is not authenticated. Subject: %s", sender.Address, entry, subject)
+				whitelisted = false
+				spoofed = true
+				signals = append(signals, SignalWhitelistSpoof)
+			}
+		}
 
 		if whitelisted {
 			continue
 		}
+		senderDomain := addressDomain(sender.Address)
+		// The domain as written, as its case matters to the eye.
+		imitated, lookalike := lookalikes.Check(sender.Address[strings.LastIndex(sender.Address, "@")+1:])
+		if lookalike {
+			signals = append(signals, SignalLookalike)
+		}
+		// The signals of the sender and its authentication do not change with
+		// the delivery, unlike those of the relays and DNSBLs added below.
+		senderSignals := signals[:len(signals):len(signals)]
 
-		spamStatus, err := ExtractSpamStatus(email)
+		verdicts, err := ParseUpstreamVerdicts(email, options.upstreamList, options.upstreamRelays)
 		if err != nil {
-			log.Printf("Error parsing Spam Status: %v", err)
-			continue
+			log.Printf("Ignoring malformed upstream verdicts: %v. From: %s. Subject: %s", err, sender.Address, subject)
+		}
+		hasSpamStatus := len(verdicts) > 0
+		var spamStatus float64
+		var context []string
+		if hasSpamStatus {
+			spamStatus = verdicts[0].Score
+		}
+		if options.upstreamCtx {
+			for _, verdict := range verdicts {
+				context = append(context, "UPSTREAM FILTER: "+verdict.String())
+			}
 		}
 
-		bodyText, err := CleanEmailBody(email)
+		for _, results := range authResults {
+			context = append(context, "AUTHENTICATION: "+results.String())
+		}
+		if dkimResult != nil {
+			context = append(context, "AUTHENTICATION: "+dkimResult.String())
+		}
+		if spoofed {
+			context = append(context, "AUTHENTICATION: WARNING the sender address is in our whitelist but it is not authenticated (no DMARC pass nor aligned DKIM signature), it may be spoofed")
+		}
+		if len(options.headerFeatures) > 0 {
+			featureContext, featureSignals := ExtractHeaderFeatures(email, sender, options.headerFeatures, options.featureRelays, time.Now())
+			context = append(context, featureContext...)
+			signals = append(signals, featureSignals...)
+		}
+		if options.received {
+			analysis := AnalyzeReceived(email.GetReceivedChain(), options.trustedRelays)
+			context = append(context, analysis.Context()...)
+			signals = append(signals, analysis.Signals()...)
+		}
+		// All the DNSBL lookups of the message share one deadline.
+		dnsblDeadline := time.Now().Add(dnsblTimeout)
+		if options.dnsbl != nil {
+			if analysis := AnalyzeReceived(email.GetReceivedChain(), options.dnsblRelays); analysis.HasOrigin {
+				hits, err := options.dnsbl.CheckIP(analysis.Origin.IP, dnsblDeadline)
+				if err != nil {
+					log.Printf("Error looking up %s in DNSBLs: %v", analysis.Origin.IP, err)
+				}
+				for _, hit := range hits {
+					context = append(context, hit.String())
+					signals = append(signals, hit.Signal())
+				}
+			}
+		}
+		if lookalike {
+			context = append(context, fmt.Sprintf("SENDER WARNING: the sender domain %s looks like %s but it is a different domain", senderDomain, imitated))
+		}
+
+		content, err := ParseEmailContentWithText(email, options.attachmentTextSize)
 		if err != nil {
 			log.Printf("Error cleaning email: %v", err)
 			continue
 		}
+		if len(content.Links) > 0 {
+			hits, err := options.dnsbl.CheckDomains(linkDomains(content.Links), dnsblDeadline)
+			if err != nil {
+				log.Printf("Error looking up link domains in URIBLs: %v", err)
+			}
+			for _, hit := range hits {
+				context = append(context, hit.String())
+				signals = append(signals, hit.Signal())
+			}
+		}
+		if condition, signal, ok := MatchCondition(options.conditions, append(content.Signals(), signals...)); ok {
+			forceVerdict(condition.Score, "Rule condition matched signal "+signal, spamStatus)
+			continue
+		}
+		// A conclusive upstream score only skips the LLM, the conditions on
+		// the content and the sender are checked first.
+		if hasSpamStatus {
+			if score, reason, skip := options.scoring.Skip(spamStatus); skip {
+				forceVerdict(score, reason, spamStatus)
+				continue
+			}
+		}
+		if probability, ok := options.bayes.Score(BayesTokens(sender, subject, content)); ok {
+			reason := fmt.Sprintf("Bayes filter spam probability %.0f%%", probability*100)
+			if probability <= options.bayesHamBelow {
+				forceVerdict(0, reason, spamStatus)
+				continue
+			}
+			if probability >= options.bayesSpamAbove {
+				forceVerdict(10, reason, spamStatus)
+				continue
+			}
+		}
+		bodyText := content.Text
+		if len(content.Links) > 0 {
+			context = append(context, "LINKS:")
+			context = append(context, SummarizeLinks(content.Links, maxPromptLinks)...)
+		}
+		if len(content.Attachments) > 0 {
+			context = append(context, "ATTACHMENTS:")
+			for _, attachment := range content.Attachments {
+				context = append(context, "- "+attachment.String())
+			}
+		}
+		if options.countTokens != nil {
+			var truncated bool
+			bodyText, truncated = TruncateBody(bodyText, options.maxTokens, options.countTokens)
+			if truncated {
+				log.Printf("Email body truncated to %d tokens. From: %s. Subject: %s", options.maxTokens, sender.Address, subject)
+			}
+		}
+		if options.attachmentTextCount != nil {
+			bodyText = appendAttachmentText(bodyText, content.Attachments, options.attachmentTextTokens, options.attachmentTextCount)
+		}
 
-		cleanedMail := fmt.Sprintf(
-			`FROM: %s
-SUBJECT: %s
-
-%s`,
-			sender, subject, bodyText)
+		cleanedMail := formatEmail(sender, subject, context, bodyText)
+		keyText := cacheText(sender, subject, append(content.Signals(), senderSignals...), bodyText)
+		embeddingText := EmbeddingText(sender, subject, bodyText)
 
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			score, reason, err := llm.ClassifyEmail(llmClassifier, cleanedMail)
+			score, reason, err := options.classifyMessage(llmClassifier, cleanedMail, keyText, embeddingText)
+			if hasSpamStatus {
+				score = options.scoring.Combine(spamStatus, score, threshold)
+			}
 			result := llmResult{
 				score:      score,
 				err:        err,
 				id:         id,
+				uid:        msg.Uid,
 				spamStatus: spamStatus,
 				reason:     reason,
 				sender:     sender.Address,
@@ -113,7 +667,16 @@ SUBJECT: %s
 		wg.Wait()
 	}()
 
+	// heldUid is the first message left for later because the budget is
+	// spent, the next run starts again from it.
+	var heldUid uint32
 	for result := range scoreChannel {
+		if errors.Is(result.err, llm.ErrBudgetExceeded) {
+			if heldUid == 0 || result.uid < heldUid {
+				heldUid = result.uid
+			}
+			continue
+		}
 		if result.err != nil {
 			log.Println(result.err)
 			continue
@@ -128,5 +691,9 @@ SUBJECT: %s
 			notSpamSeqset.AddNum(result.id)
 		}
 	}
+	if heldUid > 0 {
+		log.Printf("Daily budget exceeded, messages from UID %d are left for later", heldUid)
+		lastUid = heldUid - 1
+	}
 	return spamSeqset, notSpamSeqset, lastUid, nil
 }
@@ -5,9 +5,12 @@ import (
 	"context"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/tmc/langchaingo/llms"
+
+	"llm-antispam/llm"
 )
 
 // createIMAPMessageWithUID constructs an *imap.Message with the given UID and raw RFC822 content.
@@ -128,3 +131,468 @@ func TestClassifySpam(t *testing.T) {
 		t.Errorf("Expected lastUid to be 103, got %d", lastUid)
 	}
 }
+
+// countingLLM wraps fakeLLM and counts the calls that reach the model.
+type countingLLM struct {
+	fakeLLM
+	calls *int
+}
+
+func (c countingLLM) GenerateContent(
+	ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	*c.calls++
+	return c.fakeLLM.GenerateContent(ctx, messages, options...)
+}
+
+func TestClassifySpamWithCache(t *testing.T) {
+	// The same campaign delivered at another time through another relay.
+	received := []string{
+		"Received: from mail.example.net (mail.example.net [198.51.100.7]) by mx.example.com with ESMTP; Tue, 10 Jun 2025 10:00:00 +0000\r\n",
+		"Received: from smtp.example.org (smtp.example.org [203.0.113.9]) by mx.example.com with ESMTP; Wed, 11 Jun 2025 18:30:00 +0000\r\n",
+	}
+	body := "From: user@notwhitelisted.com\r\n" +
+		"Subject: Spam Email\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<html><body><p>Spam Content</p></body></html>"
+
+	cache, err := NewVerdictCache(t.TempDir()+"/cache.json", 0, 0)
+	if err != nil {
+		t.Fatalf("NewVerdictCache returned error: %v", err)
+	}
+	calls := 0
+	mockLLM := countingLLM{calls: &calls}
+
+	for i := 0; i < 2; i++ {
+		messages := make(chan *imap.Message, 1)
+		messages <- createIMAPMessageWithUID(uint32(101+i), received[i]+body)
+		close(messages)
+
+		spamSeqset, _, _, err := ClassifySpam(
+			messages, []uint32{10}, nil, 0.5, 0, mockLLM, false, WithCache(cache, "fake"), WithReceivedAnalysis(nil))
+		if err != nil {
+			t.Fatalf("ClassifySpam returned error: %v", err)
+		}
+		if len(spamSeqset.Set) != 1 {
+			t.Errorf("Expected message to be classified as spam, got %v", spamSeqset.Set)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 LLM call, got %d", calls)
+	}
+}
+
+func TestClassifySpamBudgetExceeded(t *testing.T) {
+	raw := "From: user@notwhitelisted.com\r\n" +
+		"Subject: Spam Email\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"Spam Content"
+
+	ledger, err := llm.NewUsageLedger(t.TempDir()+"/usage.json", map[string]llm.Price{"fake": {Prompt: 1}}, 1)
+	if err != nil {
+		t.Fatalf("NewUsageLedger returned error: %v", err)
+	}
+	ledger.Record("me", "INBOX", "fake", llm.Usage{PromptTokens: 1000})
+	calls := 0
+	mockLLM := countingLLM{calls: &calls}
+
+	messages := make(chan *imap.Message, 2)
+	messages <- createIMAPMessageWithUID(101, raw)
+	messages <- createIMAPMessageWithUID(102, raw)
+	close(messages)
+	spamSeqset, notSpamSeqset, lastUid, err := ClassifySpam(
+		messages, []uint32{1, 2}, nil, 5, 100, mockLLM, false,
+		WithUsageLedger(ledger, "me", "INBOX", "openai", "fake"))
+	if err != nil {
+		t.Fatalf("ClassifySpam returned error: %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Expected no LLM call over budget, got %d", calls)
+	}
+	if len(spamSeqset.Set) != 0 || len(notSpamSeqset.Set) != 0 {
+		t.Errorf("Expected no verdict, got %v and %v", spamSeqset.Set, notSpamSeqset.Set)
+	}
+	if lastUid != 100 {
+		t.Errorf("Expected the messages to be left for later with last UID 100, got %d", lastUid)
+	}
+}
+
+func TestClassifySpamSkipsLLMOnConfidentUpstream(t *testing.T) {
+	rawSpam := "From: user@notwhitelisted.com\r\n" +
+		"Subject: Ham Email\r\n" +
+		"X-Spam-Status: Yes, hits=25.0 required=5.0 tests=TEST\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<html><body><p>Ham Content</p></body></html>"
+	rawUnknown := "From: user@notwhitelisted.com\r\n" +
+		"Subject: Spam Email\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n\r\n" +
+		"<html><body><p>Spam Content</p></body></html>"
+
+	messages := make(chan *imap.Message, 2)
+	messages <- createIMAPMessageWithUID(101, rawSpam)
+	messages <- createIMAPMessageWithUID(102, rawUnknown)
+	close(messages)
+
+	ham, spam := -1.0, 15.0
+	calls := 0
+	spamSeqset, notSpamSeqset, _, err := ClassifySpam(
+		messages, []uint32{10, 20}, nil, 5, 0, countingLLM{calls: &calls}, false,
+		WithScoringPolicy(ScoringPolicy{SkipHamBelow: &ham, SkipSpamAbove: &spam}), WithUpstreamFilters([]string{"spamassassin"}, nil))
+	if err != nil {
+		t.Fatalf("ClassifySpam returned error: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected only the message without upstream score to reach the LLM, got %d calls", calls)
+	}
+	if !spamSeqset.Contains(10) || !spamSeqset.Contains(20) {
+		t.Errorf("Expected spamSeqset to contain [10 20], got %v", spamSeqset.Set)
+	}
+	if len(notSpamSeqset.Set) != 0 {
+		t.Errorf("Expected notSpamSeqset to be empty, got %v", notSpamSeqset.Set)
+	}
+}
+
+func TestClassifySpamConditions(t *testing.T) {
+	attachment := "--b\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"Ham Content\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream; name=\"invoice.pdf.exe\"\r\n\r\n" +
+		"MZ\r\n" +
+		"--b--\r\n"
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{
+			name: "attachment",
+			raw: "From: user@notwhitelisted.com\r\n" +
+				"Subject: Ham Email\r\n" +
+				"Content-Type: multipart/mixed; boundary=b\r\n\r\n" + attachment,
+		},
+		{
+			name: "conclusive upstream ham score",
+			raw: "X-MS-Exchange-Organization-SCL: -1\r\n" +
+				"From: user@notwhitelisted.com\r\n" +
+				"Subject: Ham Email\r\n" +
+				"Content-Type: multipart/mixed; boundary=b\r\n\r\n" + attachment,
+		},
+		{
+			name: "single-part executable",
+			raw: "From: user@notwhitelisted.com\r\n" +
+				"Subject: Ham Email\r\n" +
+				"Content-Type: application/x-msdownload; name=\"invoice.pdf.exe\"\r\n\r\n" +
+				"MZ\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := make(chan *imap.Message, 1)
+			messages <- createIMAPMessageWithUID(101, tt.raw)
+			close(messages)
+
+			ham := -2.0
+			calls := 0
+			spamSeqset, _, _, err := ClassifySpam(
+				messages, []uint32{10}, nil, 5, 0, countingLLM{calls: &calls}, false,
+				WithUpstreamFilters([]string{"microsoft"}, nil),
+				WithScoringPolicy(ScoringPolicy{SkipHamBelow: &ham}),
+				WithConditions([]Condition{{Signal: "attachment:double_extension", Score: 10}}))
+			if err != nil {
+				t.Fatalf("ClassifySpam returned error: %v", err)
+			}
+			if calls != 0 {
+				t.Errorf("Expected the condition to skip the LLM, got %d calls", calls)
+			}
+			if !spamSeqset.Contains(10) {
+				t.Errorf("Expected spamSeqset to contain 10, got %v", spamSeqset.Set)
+			}
+		})
+	}
+}
+
+func TestClassifySpamAuthConditions(t *testing.T) {
+	raw := "Authentication-Results: mx.example.com; dmarc=fail header.from=bank.com\r\n" +
+		"From: support@bank.com\r\n" +
+		"Subject: Ham Email\r\n\r\n" +
+		"Ham Content\r\n"
+
+	messages := make(chan *imap.Message, 1)
+	messages <- createIMAPMessageWithUID(101, raw)
+	close(messages)
+
+	calls := 0
+	spamSeqset, _, _, err := ClassifySpam(
+		messages, []uint32{10}, nil, 5, 0, countingLLM{calls: &calls}, false,
+		WithAuthServIDs([]string{"mx.example.com"}),
+		WithConditions([]Condition{{Signal: "auth:dmarc=fail", Score: 10}}))
+	if err != nil {
+		t.Fatalf("ClassifySpam returned error: %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Expected the condition to skip the LLM, got %d calls", calls)
+	}
+	if !spamSeqset.Contains(10) {
+		t.Errorf("Expected spamSeqset to contain 10, got %v", spamSeqset.Set)
+	}
+}
+
+func TestClassifySpamAuthenticatedWhitelist(t *testing.T) {
+	rawSpoofed := "From: support@bank.com\r\n" +
+		"Subject: Spoofed Email\r\n\r\n" +
+		"Verify your account\r\n"
+	rawAuthenticated := "Authentication-Results: mx.example.com; dkim=pass header.d=bank.com\r\n" +
+		"From: support@bank.com\r\n" +
+		"Subject: Statement\r\n\r\n" +
+		"Your statement is ready\r\n"
+	// DKIM authenticates the From domain, not the whitelisted Sender.
+	rawSender := "Authentication-Results: mx.example.com; dkim=pass header.d=evil.example\r\n" +
+		"Sender: support@bank.com\r\n" +
+		"From: support@evil.example\r\n" +
+		"Subject: Spoofed Email\r\n\r\n" +
+		"Verify your account\r\n"
+
+	messages := make(chan *imap.Message, 3)
+	messages <- createIMAPMessageWithUID(101, rawSpoofed)
+	messages <- createIMAPMessageWithUID(102, rawAuthenticated)
+	messages <- createIMAPMessageWithUID(103, rawSender)
+	close(messages)
+
+	calls := 0
+	spamSeqset, notSpamSeqset, _, err := ClassifySpam(
+		messages, []uint32{10, 20, 30}, []string{"bank.com"}, 5, 0, countingLLM{calls: &calls}, false,
+		WithAuthServIDs([]string{"mx.example.com"}),
+		WithAuthenticatedWhitelist(),
+		WithConditions([]Condition{{Signal: SignalWhitelistSpoof, Score: 9}}))
+	if err != nil {
+		t.Fatalf("ClassifySpam returned error: %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Expected no LLM calls, got %d", calls)
+	}
+	if !spamSeqset.Contains(10) || !spamSeqset.Contains(30) || spamSeqset.Contains(20) || notSpamSeqset.Contains(20) {
+		t.Errorf("Expected only the spoofed messages to be classified, got spam %v and not spam %v", spamSeqset.Set, notSpamSeqset.Set)
+	}
+}
+
+func TestClassifySpamDKIMWhitelist(t *testing.T) {
+	raw := "From: support@bank.com\r\n" +
+		"Subject: Statement\r\n\r\n" +
+		"Your statement is ready\r\n"
+	signed, resolver := signEmail(t, raw, "bank.com")
+
+	messages := make(chan *imap.Message, 1)
+	messages <- createIMAPMessageWithUID(101, signed)
+	close(messages)
+
+	calls := 0
+	spamSeqset, notSpamSeqset, _, err := ClassifySpam(
+		messages, []uint32{10}, []string{"bank.com"}, 5, 0, countingLLM{calls: &calls}, false,
+		WithAuthenticatedWhitelist(), WithDKIMVerification(resolver))
+	if err != nil {
+		t.Fatalf("ClassifySpam returned error: %v", err)
+	}
+	if calls != 0 || len(spamSeqset.Set) != 0 || len(notSpamSeqset.Set) != 0 {
+		t.Errorf("Expected the authenticated sender to be whitelisted, got %d calls", calls)
+	}
+}
+
+func TestClassifySpamBlocklist(t *testing.T) {
+	raw := "From: user@spam.example\r\n" +
+		"Subject: Ham Email\r\n\r\n" +
+		"Ham Content\r\n"
+
+	messages := make(chan *imap.Message, 1)
+	messages <- createIMAPMessageWithUID(101, raw)
+	close(messages)
+
+	blocklist, err := NewListSource([]string{"spam.example"})
+	if err != nil {
+		t.Fatalf("NewListSource returned error: %v", err)
+	}
+	calls := 0
+	spamSeqset, _, _, err := ClassifySpam(
+		messages, []uint32{10}, []string{"spam.example"}, 5, 0, countingLLM{calls: &calls}, false,
+		WithBlocklist(blocklist, 10))
+	if err != nil {
+		t.Fatalf("ClassifySpam returned error: %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Expected the blocklist to skip the LLM, got %d calls", calls)
+	}
+	if !spamSeqset.Contains(10) {
+		t.Errorf("Expected spamSeqset to contain 10, got %v", spamSeqset.Set)
+	}
+}
+
+func TestClassifySpamContacts(t *testing.T) {
+	raw := "From: friend@example.com\r\n" +
+		"Subject: Spam Email\r\n\r\n" +
+		"Spam Content\r\n"
+
+	messages := make(chan *imap.Message, 1)
+	messages <- createIMAPMessageWithUID(101, raw)
+	close(messages)
+
+	book, err := NewContactBook(t.TempDir()+"/contacts.json", 0)
+	if err != nil {
+		t.Fatalf("NewContactBook returned error: %v", err)
+	}
+	book.Add("friend@example.com", time.Now())
+
+	calls := 0
+	spamSeqset, _, _, err := ClassifySpam(
+		messages, []uint32{10}, nil, 5, 0, countingLLM{calls: &calls}, false, WithContacts(book))
+	if err != nil {
+		t.Fatalf("ClassifySpam returned error: %v", err)
+	}
+	if calls != 0 || len(spamSeqset.Set) != 0 {
+		t.Errorf("Expected the contact to be whitelisted, got %d calls", calls)
+	}
+}
+
+func TestClassifySpamLookalike(t *testing.T) {
+	raw := "From: support@xn--pypal-4ve.com\r\n" +
+		"Subject: Ham Email\r\n\r\n" +
+		"Ham Content\r\n"
+
+	messages := make(chan *imap.Message, 1)
+	messages <- createIMAPMessageWithUID(101, raw)
+	close(messages)
+
+	calls := 0
+	spamSeqset, _, _, err := ClassifySpam(
+		messages, []uint32{10}, []string{"paypal.com"}, 5, 0, countingLLM{calls: &calls}, false,
+		WithLookalikeDetection(nil),
+		WithConditions([]Condition{{Signal: SignalLookalike, Score: 10}}))
+	if err != nil {
+		t.Fatalf("ClassifySpam returned error: %v", err)
+	}
+	if calls != 0 || !spamSeqset.Contains(10) {
+		t.Errorf("Expected the lookalike sender to be flagged, got %d calls and spam %v", calls, spamSeqset.Set)
+	}
+}
+
+func TestClassifySpamDNSBL(t *testing.T) {
+	resolver := fakeHostResolver{
+		"7.100.51.198.zen.example": {"127.0.0.2"},
+		"evil.example.dbl.example": {"127.0.1.2"},
+	}
+	tests := []struct {
+		name   string
+		raw    string
+		signal string
+	}{
+		{
+			name: "origin ip",
+			raw: "Received: from mail.example.net (mail.example.net [198.51.100.7]) by mx.example.com with ESMTP; Tue, 10 Jun 2025 10:00:00 +0000\r\n" +
+				"From: sender@example.net\r\n" +
+				"Subject: Hello\r\n\r\n" +
+				"Hello\r\n",
+			signal: "dnsbl:zen.example",
+		},
+		{
+			name: "origin behind a trusted relay",
+			raw: "Received: from relay.example.com (relay.example.com [203.0.113.5]) by mx.example.com with ESMTP; Tue, 10 Jun 2025 10:00:01 +0000\r\n" +
+				"Received: from mail.example.net (mail.example.net [198.51.100.7]) by relay.example.com with ESMTP; Tue, 10 Jun 2025 10:00:00 +0000\r\n" +
+				"From: sender@example.net\r\n" +
+				"Subject: Hello\r\n\r\n" +
+				"Hello\r\n",
+			signal: "dnsbl:zen.example",
+		},
+		{
+			name: "link domain",
+			raw: "From: sender@example.net\r\n" +
+				"Subject: Hello\r\n\r\n" +
+				"Visit https://www.evil.example/login now\r\n",
+			signal: "uribl:*",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := make(chan *imap.Message, 1)
+			messages <- createIMAPMessageWithUID(101, tt.raw)
+			close(messages)
+
+			trusted, err := ParseTrustedRelays([]string{"203.0.113.5"})
+			if err != nil {
+				t.Fatalf("ParseTrustedRelays returned error: %v", err)
+			}
+			calls := 0
+			spamSeqset, _, _, err := ClassifySpam(
+				messages, []uint32{10}, nil, 5, 0, countingLLM{calls: &calls}, false,
+				WithDNSBL(NewDNSBLChecker(resolver, []string{"zen.example"}, []string{"dbl.example"}), trusted),
+				WithConditions([]Condition{{Signal: tt.signal, Score: 10}}))
+			if err != nil {
+				t.Fatalf("ClassifySpam returned error: %v", err)
+			}
+			if calls != 0 || !spamSeqset.Contains(10) {
+				t.Errorf("Expected the listed message to match %s, got %d calls and spam %v", tt.signal, calls, spamSeqset.Set)
+			}
+		})
+	}
+}
+
+func TestClassifySpamBayesFilter(t *testing.T) {
+	model := trainedBayesModel(t, t.TempDir()+"/bayes.json")
+	messages := make(chan *imap.Message, 3)
+	messages <- createIMAPMessageWithUID(101, "From: deals@spam.example\r\nSubject: Offer\r\n\r\nHuge discount on cheap pills, buy now\r\n")
+	messages <- createIMAPMessageWithUID(102, "From: boss@example.com\r\nSubject: Project\r\n\r\nNotes of the meeting on Thursday\r\n")
+	messages <- createIMAPMessageWithUID(103, "From: someone@example.org\r\nSubject: Hello\r\n\r\nSomething unusual\r\n")
+	close(messages)
+
+	calls := 0
+	spamSeqset, notSpamSeqset, _, err := ClassifySpam(
+		messages, []uint32{10, 11, 12}, nil, 5, 0, countingLLM{calls: &calls}, false,
+		WithBayesFilter(model, 0.05, 0.95))
+	if err != nil {
+		t.Fatalf("ClassifySpam returned error: %v", err)
+	}
+	if !spamSeqset.Contains(10) || !notSpamSeqset.Contains(11) {
+		t.Errorf("Expected the Bayes filter verdicts, got spam %v and not spam %v", spamSeqset.Set, notSpamSeqset.Set)
+	}
+	if calls != 1 {
+		t.Errorf("Expected only the uncertain message to reach the LLM, got %d calls", calls)
+	}
+}
+
+func TestClassifySpamKNN(t *testing.T) {
+	store := trainedVectorStore(t, t.TempDir()+"/vectors.json")
+	tests := []struct {
+		name   string
+		policy KNNPolicy
+		body   string
+		calls  int
+		spam   bool
+	}{
+		// fakeLLM scores 10 and the k-NN classifier 0, the threshold is 5.
+		{name: "alone", policy: KNNPolicy{Mode: KNNAlone, K: 3}, calls: 0, spam: false},
+		{name: "combined", policy: KNNPolicy{Mode: KNNCombined, K: 3, Weight: 0.5}, calls: 1, spam: false},
+		{name: "light weight", policy: KNNPolicy{K: 3, Weight: 0.25}, calls: 1, spam: true},
+		{name: "alone unlike known messages", policy: KNNPolicy{Mode: KNNAlone, K: 3, MinSimilarity: 0.9}, body: "Lottery notes", calls: 1, spam: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.body
+			if body == "" {
+				body = "Notes of the meeting"
+			}
+			messages := make(chan *imap.Message, 1)
+			messages <- createIMAPMessageWithUID(101, "From: boss@example.com\r\nSubject: Project\r\n\r\n"+body+"\r\n")
+			close(messages)
+
+			calls := 0
+			spamSeqset, notSpamSeqset, _, err := ClassifySpam(
+				messages, []uint32{10}, nil, 5, 0, countingLLM{calls: &calls}, false,
+				WithKNNClassifier(fakeEmbedder{}, store, tt.policy))
+			if err != nil {
+				t.Fatalf("ClassifySpam returned error: %v", err)
+			}
+			if calls != tt.calls {
+				t.Errorf("Expected %d LLM calls, got %d", tt.calls, calls)
+			}
+			if spamSeqset.Contains(10) != tt.spam || notSpamSeqset.Contains(10) == tt.spam {
+				t.Errorf("Expected spam %v, got spam %v and not spam %v", tt.spam, spamSeqset.Set, notSpamSeqset.Set)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package mailhelper
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var urlRe = regexp.MustCompile(`(?i)\bhttps?://[^\s"'<>()\[\]]+`)
+
+// TruncateBody shrinks body so it fits in maxTokens as measured by count. It
+// keeps the beginning and the end of the body, lists the links found in the
+// removed middle part and adds a note so the model knows the body is partial.
+// It returns the body unchanged and false if it already fits.
+func TruncateBody(body string, maxTokens int, count func(string) int) (string, bool) {
+	if maxTokens <= 0 || count(body) <= maxTokens {
+		return body, false
+	}
+
+	runes := []rune(body)
+	keep := len(runes) * maxTokens / count(body)
+	for keep > 0 {
+		head := keep * 2 / 3
+		tail := keep - head
+		removed := string(runes[head : len(runes)-tail])
+		truncated := formatTruncated(string(runes[:head]), string(runes[len(runes)-tail:]), removed, len(runes)-keep, maxTokens/4, count)
+		if count(truncated) <= maxTokens {
+			return truncated, true
+		}
+		keep = keep * 9 / 10
+	}
+	return clampTokens(formatTruncated("", "", body, len(runes), maxTokens/4, count), maxTokens, count), true
+}
+
+// clampTokens returns the longest beginning of text that fits in maxTokens.
+func clampTokens(text string, maxTokens int, count func(string) int) string {
+	if count(text) <= maxTokens {
+		return text
+	}
+	runes := []rune(text)
+	low, high := 0, len(runes)
+	for low < high {
+		middle := (low + high + 1) / 2
+		if count(string(runes[:middle])) <= maxTokens {
+			low = middle
+		} else {
+			high = middle - 1
+		}
+	}
+	return string(runes[:low])
+}
+
+// formatTruncated joins the kept head and tail with a marker, followed by the
+// links of the removed part that fit in linkBudget tokens.
+func formatTruncated(head, tail, removed string, removedChars int, linkBudget int, count func(string) int) string {
+	var builder strings.Builder
+	builder.WriteString("[NOTE: This email body was truncated to fit the size limit. The beginning and the end are kept, the links of the removed part are listed at the end.]\n\n")
+	builder.WriteString(head)
+	builder.WriteString(fmt.Sprintf("\n[... %d characters removed ...]\n", removedChars))
+	builder.WriteString(tail)
+
+	seen := map[string]bool{}
+	var links []string
+	used := 0
+	for _, link := range urlRe.FindAllString(removed, -1) {
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+		used += count(link)
+		if used > linkBudget {
+			break
+		}
+		links = append(links, link)
+	}
+	if len(links) > 0 {
+		builder.WriteString("\n\nLinks in the removed part:\n")
+		builder.WriteString(strings.Join(links, "\n"))
+	}
+	return builder.String()
+}
@@ -0,0 +1,54 @@
+package mailhelper
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTruncateBody(t *testing.T) {
+	count := func(s string) int { return len(s) / 4 }
+
+	t.Run("body within budget", func(t *testing.T) {
+		body := "short body"
+		got, truncated := TruncateBody(body, 100, count)
+		if truncated || got != body {
+			t.Errorf("Expected body to be unchanged, got %q", got)
+		}
+	})
+
+	t.Run("no budget", func(t *testing.T) {
+		body := strings.Repeat("long ", 1000)
+		if _, truncated := TruncateBody(body, 0, count); truncated {
+			t.Errorf("Expected a zero budget to disable truncation")
+		}
+	})
+
+	t.Run("long body keeps start, end and links", func(t *testing.T) {
+		body := "START " + strings.Repeat("filler ", 500) +
+			"click https://evil.example.com/login now " +
+			strings.Repeat("filler ", 500) + " END"
+		got, truncated := TruncateBody(body, 300, count)
+		if !truncated {
+			t.Fatalf("Expected body to be truncated")
+		}
+		if count(got) > 300 {
+			t.Errorf("Expected at most 300 tokens, got %d", count(got))
+		}
+		for _, want := range []string{"[NOTE:", "START", "END", "https://evil.example.com/login", "characters removed"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("Expected truncated body to contain %q, got %q", want, got)
+			}
+		}
+	})
+
+	t.Run("tiny budget stays within budget", func(t *testing.T) {
+		body := strings.Repeat("word https://example.com/a-long-link ", 200)
+		got, truncated := TruncateBody(body, 5, count)
+		if !truncated {
+			t.Fatalf("Expected body to be truncated")
+		}
+		if count(got) > 5 {
+			t.Errorf("Expected at most 5 tokens, got %d: %q", count(got), got)
+		}
+	})
+}
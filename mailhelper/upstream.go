@@ -0,0 +1,286 @@
+package mailhelper
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// UpstreamVerdict is the verdict of an upstream spam filter normalized to the
+// SpamAssassin scale, where 5 is the usual spam threshold.
+type UpstreamVerdict struct {
+	Source  string
+	Score   float64
+	Symbols []string
+}
+
+// String formats the verdict for the logs and the LLM prompt.
+func (v UpstreamVerdict) String() string {
+	if len(v.Symbols) == 0 {
+		return fmt.Sprintf("%s score %.2f", v.Source, v.Score)
+	}
+	return fmt.Sprintf("%s score %.2f, symbols: %s", v.Source, v.Score, strings.Join(v.Symbols, ", "))
+}
+
+// UpstreamParser extracts the verdict of a filter from the email headers. It
+// returns false if the headers of the filter are not present.
+type UpstreamParser func(header mail.Header) (UpstreamVerdict, bool, error)
+
+type namedUpstreamParser struct {
+	name   string
+	parser UpstreamParser
+}
+
+// upstreamParsers are the registered parsers in priority order.
+var upstreamParsers = []namedUpstreamParser{
+	{name: "spamassassin", parser: parseSpamAssassin},
+	{name: "rspamd", parser: parseRspamd},
+	{name: "microsoft", parser: parseMicrosoft},
+	{name: "gmail", parser: parseGmail},
+}
+
+// RegisterUpstreamParser adds a parser for another upstream filter, or
+// replaces the parser registered with the same name.
+func RegisterUpstreamParser(name string, parser UpstreamParser) {
+	for i, p := range upstreamParsers {
+		if p.name == name {
+			upstreamParsers[i].parser = parser
+			return
+		}
+	}
+	upstreamParsers = append(upstreamParsers, namedUpstreamParser{name: name, parser: parser})
+}
+
+// ValidateUpstreamFilters checks that every name is a registered upstream
+// filter.
+func ValidateUpstreamFilters(names []string) error {
+	for _, name := range names {
+		if _, ok := findUpstreamParser(name); !ok {
+			return fmt.Errorf("unknown upstream filter %q", name)
+		}
+	}
+	return nil
+}
+
+func findUpstreamParser(name string) (namedUpstreamParser, bool) {
+	for _, p := range upstreamParsers {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return namedUpstreamParser{}, false
+}
+
+// ParseUpstreamVerdicts returns the verdicts of the trusted upstream filters
+// found in the email headers, in the order of filters. Filters not listed are
+// not trusted, as anybody can write their headers. Only the headers added by
+// our servers are read, see ourHeaders. Malformed headers only drop the
+// verdict of their filter, the errors are returned with the other verdicts.
+func ParseUpstreamVerdicts(email *Email, filters []string, trusted *TrustedRelays) ([]UpstreamVerdict, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	header := ourHeaders(email, trusted)
+	var verdicts []UpstreamVerdict
+	var errs []error
+	for _, name := range filters {
+		p, ok := findUpstreamParser(name)
+		if !ok {
+			continue
+		}
+		verdict, found, err := p.parser(header)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error parsing %s headers: %v", p.name, err))
+			continue
+		}
+		if found {
+			verdicts = append(verdicts, verdict)
+		}
+	}
+	return verdicts, errors.Join(errs...)
+}
+
+// UpstreamVerdictFor returns the verdict of the first trusted upstream filter
+// found in the email headers.
+func UpstreamVerdictFor(email *Email, filters []string, trusted *TrustedRelays) (UpstreamVerdict, bool, error) {
+	verdicts, err := ParseUpstreamVerdicts(email, filters, trusted)
+	if len(verdicts) == 0 {
+		return UpstreamVerdict{}, false, err
+	}
+	return verdicts[0], true, err
+}
+
+// ourHeaders returns the headers added by our servers: those above the
+// Received header in which they recorded the first hop outside of trusted.
+// The headers below it were written by the sender or by servers we do not
+// run, and may carry forged verdicts. Parsers reading the first value of a
+// header get the topmost one added by our servers.
+func ourHeaders(email *Email, trusted *TrustedRelays) mail.Header {
+	fields := email.headerFields()
+	var chain []Hop
+	var positions []int
+	for i, field := range fields {
+		if field.name != "Received" {
+			continue
+		}
+		if hop, err := ParseReceived(field.value); err == nil {
+			chain = append(chain, hop)
+			positions = append(positions, i)
+		}
+	}
+	end := len(fields)
+	if i := receivedWalkEnd(chain, trusted); i < len(chain) {
+		end = positions[i]
+	}
+	header := mail.Header{}
+	for _, field := range fields[:end] {
+		header[field.name] = append(header[field.name], field.value)
+	}
+	return header
+}
+
+var (
+	saScoreRe    = regexp.MustCompile(`\b(?:hits|score)=(-?[\d\.]+)`)
+	saRequiredRe = regexp.MustCompile(`\brequired=(-?[\d\.]+)`)
+	saTestsRe    = regexp.MustCompile(`\btests=([^\s]+(?:,\s*[^\s]+)*)`)
+)
+
+// parseSpamAssassin reads X-Spam-Status (hits= or score=), falling back to
+// X-Spam-Score. Scores are rescaled when required= is not the default 5.
+func parseSpamAssassin(header mail.Header) (UpstreamVerdict, bool, error) {
+	verdict := UpstreamVerdict{Source: "spamassassin"}
+	status := header.Get("X-Spam-Status")
+	matches := saScoreRe.FindStringSubmatch(status)
+	if len(matches) < 2 {
+		value := strings.TrimSpace(header.Get("X-Spam-Score"))
+		if value == "" {
+			return verdict, false, nil
+		}
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return verdict, false, fmt.Errorf("error parsing float: %v", err)
+		}
+		verdict.Score = score
+		return verdict, true, nil
+	}
+
+	score, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return verdict, false, fmt.Errorf("error parsing float: %v", err)
+	}
+	if required := saRequiredRe.FindStringSubmatch(status); len(required) == 2 {
+		if r, err := strconv.ParseFloat(required[1], 64); err == nil && r > 0 {
+			score = score / r * 5
+		}
+	}
+	verdict.Score = score
+
+	if tests := saTestsRe.FindStringSubmatch(status); len(tests) == 2 {
+		for _, test := range strings.Split(tests[1], ",") {
+			// Tests may carry their score, e.g. BAYES_00=-1.9
+			name, _, _ := strings.Cut(strings.TrimSpace(test), "=")
+			if name != "" && name != "none" {
+				verdict.Symbols = append(verdict.Symbols, name)
+			}
+		}
+	}
+	return verdict, true, nil
+}
+
+// rspamdAddHeaderScore is the default Rspamd score of the "add header" action,
+// used to rescale Rspamd scores to the SpamAssassin scale.
+const rspamdAddHeaderScore = 6.0
+
+var (
+	rspamdResultRe = regexp.MustCompile(`\[\s*(-?[\d\.]+)\s*/\s*-?[\d\.]+\s*\]`)
+	rspamdSymbolRe = regexp.MustCompile(`([A-Z][A-Z0-9_]+)\((-?[\d\.]+)\)`)
+)
+
+// parseRspamd reads X-Spamd-Result (score and symbols) or X-Rspamd-Score.
+func parseRspamd(header mail.Header) (UpstreamVerdict, bool, error) {
+	verdict := UpstreamVerdict{Source: "rspamd"}
+	result := header.Get("X-Spamd-Result")
+	value := strings.TrimSpace(header.Get("X-Rspamd-Score"))
+	if matches := rspamdResultRe.FindStringSubmatch(result); len(matches) == 2 {
+		value = matches[1]
+	}
+	if value == "" {
+		return verdict, false, nil
+	}
+	score, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return verdict, false, fmt.Errorf("error parsing float: %v", err)
+	}
+	verdict.Score = score / rspamdAddHeaderScore * 5
+
+	for _, symbol := range rspamdSymbolRe.FindAllStringSubmatch(result, -1) {
+		verdict.Symbols = append(verdict.Symbols, symbol[1])
+	}
+	return verdict, true, nil
+}
+
+// parseMicrosoft reads the spam confidence level (SCL) of Exchange Online
+// Protection, from X-MS-Exchange-Organization-SCL or X-Forefront-Antispam-Report.
+// SCL goes from 0 to 9 with 5 as spam, so it is used as is, while -1 (trusted
+// sender) is mapped to -5.
+func parseMicrosoft(header mail.Header) (UpstreamVerdict, bool, error) {
+	verdict := UpstreamVerdict{Source: "microsoft"}
+	value := strings.TrimSpace(header.Get("X-MS-Exchange-Organization-SCL"))
+
+	for _, field := range strings.Split(header.Get("X-Forefront-Antispam-Report"), ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(field), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "SCL":
+			if value == "" {
+				value = val
+			}
+		case "SFV":
+			verdict.Symbols = append(verdict.Symbols, "SFV:"+val)
+		case "CAT":
+			if val != "NONE" {
+				verdict.Symbols = append(verdict.Symbols, "CAT:"+val)
+			}
+		}
+	}
+	if value == "" {
+		return verdict, false, nil
+	}
+	scl, err := strconv.Atoi(value)
+	if err != nil {
+		return verdict, false, fmt.Errorf("error parsing SCL: %v", err)
+	}
+	if scl < 0 {
+		verdict.Score = -5
+	} else {
+		verdict.Score = float64(scl)
+	}
+	return verdict, true, nil
+}
+
+// parseGmail reads the X-Gm-Spam and X-Gm-Phishy flags found in messages
+// exported or forwarded from Gmail.
+func parseGmail(header mail.Header) (UpstreamVerdict, bool, error) {
+	verdict := UpstreamVerdict{Source: "gmail"}
+	found := false
+	for _, h := range []struct{ name, symbol string }{
+		{"X-Gm-Spam", "GMAIL_SPAM"},
+		{"X-Gm-Phishy", "GMAIL_PHISHY"},
+	} {
+		value := strings.TrimSpace(header.Get(h.name))
+		if value == "" {
+			continue
+		}
+		found = true
+		if value != "0" {
+			verdict.Score = 10
+			verdict.Symbols = append(verdict.Symbols, h.symbol)
+		}
+	}
+	return verdict, found, nil
+}
@@ -0,0 +1,180 @@
+package mailhelper
+
+import (
+	"math"
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+// allUpstreamFilters are the built-in filters in their priority order.
+var allUpstreamFilters = []string{"spamassassin", "rspamd", "microsoft", "gmail"}
+
+func TestParseUpstreamVerdicts(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []UpstreamVerdict
+	}{
+		{
+			name: "no upstream headers",
+			raw:  "Subject: Hi\r\n\r\nBody",
+			want: nil,
+		},
+		{
+			name: "spamassassin hits with tests",
+			raw:  "X-Spam-Status: Yes, hits=7.5 required=5.0 tests=BAYES_99=3.5,URIBL_BLACK autolearn=no\r\n\r\nBody",
+			want: []UpstreamVerdict{{Source: "spamassassin", Score: 7.5, Symbols: []string{"BAYES_99", "URIBL_BLACK"}}},
+		},
+		{
+			name: "spamassassin score variant rescaled by required",
+			raw:  "X-Spam-Status: No, score=2.0 required=10.0 tests=none\r\n\r\nBody",
+			want: []UpstreamVerdict{{Source: "spamassassin", Score: 1}},
+		},
+		{
+			name: "spamassassin score header",
+			raw:  "X-Spam-Score: 3.2\r\n\r\nBody",
+			want: []UpstreamVerdict{{Source: "spamassassin", Score: 3.2}},
+		},
+		{
+			name: "rspamd result with symbols",
+			raw: "X-Spamd-Result: default: False [12.00 / 15.00]; BAYES_SPAM(5.10)[99.99%]; " +
+				"R_SPF_FAIL(1.00)[-all]; MIME_GOOD(-0.10)[text/plain]\r\n\r\nBody",
+			want: []UpstreamVerdict{{Source: "rspamd", Score: 10, Symbols: []string{"BAYES_SPAM", "R_SPF_FAIL", "MIME_GOOD"}}},
+		},
+		{
+			name: "rspamd score header",
+			raw:  "X-Rspamd-Score: 3.00\r\n\r\nBody",
+			want: []UpstreamVerdict{{Source: "rspamd", Score: 2.5}},
+		},
+		{
+			name: "microsoft forefront report",
+			raw:  "X-Forefront-Antispam-Report: CIP:1.2.3.4;CTRY:;LANG:en;SCL:6;SRV:;IPV:NLI;SFV:SPM;CAT:PHSH;DIR:INB;\r\n\r\nBody",
+			want: []UpstreamVerdict{{Source: "microsoft", Score: 6, Symbols: []string{"SFV:SPM", "CAT:PHSH"}}},
+		},
+		{
+			name: "microsoft trusted SCL",
+			raw:  "X-MS-Exchange-Organization-SCL: -1\r\n\r\nBody",
+			want: []UpstreamVerdict{{Source: "microsoft", Score: -5}},
+		},
+		{
+			name: "gmail flags",
+			raw:  "X-Gm-Spam: 0\r\nX-Gm-Phishy: 1\r\n\r\nBody",
+			want: []UpstreamVerdict{{Source: "gmail", Score: 10, Symbols: []string{"GMAIL_PHISHY"}}},
+		},
+		{
+			name: "several filters in priority order",
+			raw:  "X-Rspamd-Score: 0\r\nX-Spam-Status: No, hits=1.0 required=5.0\r\n\r\nBody",
+			want: []UpstreamVerdict{{Source: "spamassassin", Score: 1}, {Source: "rspamd", Score: 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUpstreamVerdicts(createTestEmail(tt.raw), allUpstreamFilters, nil)
+			if err != nil {
+				t.Fatalf("ParseUpstreamVerdicts returned error: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %d verdicts, got %+v", len(tt.want), got)
+			}
+			for i := range got {
+				if got[i].Source != tt.want[i].Source || math.Abs(got[i].Score-tt.want[i].Score) > 1e-9 ||
+					!reflect.DeepEqual(got[i].Symbols, tt.want[i].Symbols) {
+					t.Errorf("Expected verdict %+v, got %+v", tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseUpstreamVerdictsInvalidScore(t *testing.T) {
+	verdicts, err := ParseUpstreamVerdicts(createTestEmail("X-Rspamd-Score: high\r\nX-Spam-Score: 3\r\n\r\nBody"), allUpstreamFilters, nil)
+	if err == nil {
+		t.Errorf("Expected error for invalid score")
+	}
+	if len(verdicts) != 1 || verdicts[0].Source != "spamassassin" {
+		t.Errorf("Expected only the valid verdict to be kept, got %+v", verdicts)
+	}
+}
+
+func TestParseUpstreamVerdictsTrustedFilters(t *testing.T) {
+	raw := "X-Rspamd-Score: 0\r\nX-Spam-Status: No, hits=1.0 required=5.0\r\nX-Gm-Spam: 1\r\n\r\nBody"
+	verdicts, err := ParseUpstreamVerdicts(createTestEmail(raw), []string{"rspamd", "spamassassin"}, nil)
+	if err != nil {
+		t.Fatalf("ParseUpstreamVerdicts returned error: %v", err)
+	}
+	if len(verdicts) != 2 || verdicts[0].Source != "rspamd" || verdicts[1].Source != "spamassassin" {
+		t.Errorf("Expected the rspamd then spamassassin verdicts, got %+v", verdicts)
+	}
+	if err := ValidateUpstreamFilters([]string{"spamassassin", "barracuda"}); err == nil {
+		t.Errorf("Expected error for unknown filter")
+	}
+	if verdicts, _ := ParseUpstreamVerdicts(createTestEmail(raw), nil, nil); len(verdicts) != 0 {
+		t.Errorf("Expected no filter to be trusted by default, got %+v", verdicts)
+	}
+}
+
+func TestParseUpstreamVerdictsOurHeaders(t *testing.T) {
+	received := "Received: from mail.example.net (mail.example.net [198.51.100.7]) by mx.example.com with ESMTP; Tue, 10 Jun 2025 10:00:00 +0000\r\n"
+	tests := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{
+			name: "headers written by the sender",
+			raw:  received + "X-Spam-Status: No, hits=-10.0 required=5.0\r\nX-MS-Exchange-Organization-SCL: -1\r\nX-Gm-Spam: 0\r\n\r\nBody",
+			want: nil,
+		},
+		{
+			name: "our header above the forged ones",
+			raw:  "X-Spam-Status: Yes, hits=8.0 required=5.0\r\n" + received + "X-Spam-Status: No, hits=-10.0 required=5.0\r\nX-Gm-Spam: 0\r\n\r\nBody",
+			want: []string{"spamassassin score 8.00"},
+		},
+		{
+			name: "topmost of our headers",
+			raw: "X-Spam-Status: Yes, hits=8.0 required=5.0\r\nX-Spam-Status: No, hits=1.0 required=5.0\r\n" +
+				"Received: from relay.example.com (relay.example.com [192.168.1.2]) by mx.example.com with ESMTP; Tue, 10 Jun 2025 10:00:01 +0000\r\n" +
+				received + "\r\nBody",
+			want: []string{"spamassassin score 8.00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdicts, err := ParseUpstreamVerdicts(createTestEmail(tt.raw), allUpstreamFilters, nil)
+			if err != nil {
+				t.Fatalf("ParseUpstreamVerdicts returned error: %v", err)
+			}
+			var got []string
+			for _, verdict := range verdicts {
+				got = append(got, verdict.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseUpstreamVerdicts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterUpstreamParser(t *testing.T) {
+	saved := append([]namedUpstreamParser(nil), upstreamParsers...)
+	t.Cleanup(func() { upstreamParsers = saved })
+
+	RegisterUpstreamParser("custom", func(header mail.Header) (UpstreamVerdict, bool, error) {
+		if header.Get("X-Custom-Spam") == "" {
+			return UpstreamVerdict{}, false, nil
+		}
+		return UpstreamVerdict{Source: "custom", Score: 9}, true, nil
+	})
+
+	verdict, found, err := UpstreamVerdictFor(createTestEmail("X-Custom-Spam: yes\r\n\r\nBody"), []string{"custom"}, nil)
+	if err != nil {
+		t.Fatalf("UpstreamVerdictFor returned error: %v", err)
+	}
+	if !found || verdict.Source != "custom" || verdict.Score != 9 {
+		t.Errorf("Expected custom verdict, got %+v", verdict)
+	}
+	if verdict.String() != "custom score 9.00" {
+		t.Errorf("Unexpected verdict string %q", verdict.String())
+	}
+}
@@ -15,36 +15,50 @@ type Config struct {
 // Note: A wildcard entry like "*.apple.com" matches subdomains (e.g. "foo.apple.com")
 // but does not match "apple.com" itself.
 func IsWhitelistedEmail(email string, allowed []string) bool {
+	_, ok := MatchWhitelist(email, allowed)
+	return ok
+}
+
+// MatchWhitelist works like IsWhitelistedEmail and also returns the matching
+// entry.
+func MatchWhitelist(email string, allowed []string) (string, bool) {
+	for _, a := range allowed {
+		if matchAddress(email, a) {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+// matchAddress returns true if the email matches the allowed entry, a full
+// address, a domain ("gmail.com" or "*@gmail.com") or a wildcard domain.
+// Domains are compared in their normalized form, see NormalizeDomain.
+func matchAddress(email string, a string) bool {
 	// Split the email into local part and domain.
 	parts := strings.Split(email, "@")
 	if len(parts) != 2 {
 		return false // invalid email address format
 	}
-	domain := parts[1]
+	domain := NormalizeDomain(parts[1])
 
-	// Iterate through each allowed entry.
-	for _, a := range allowed {
-		// If the allowed entry is an exact match for the whole email address.
-		if strings.EqualFold(email, a) {
-			return true
-		}
-		// If the allowed entry does not contain an "@" then treat it as a domain.
-		if !strings.Contains(a, "@") {
-			// Check for a wildcard domain.
-			if strings.HasPrefix(a, "*.") {
-				// Trim the "*." prefix to get the base domain.
-				baseDomain := strings.TrimPrefix(a, "*.")
-				// Check that the email's domain ends with the base domain preceded by a dot.
-				if strings.HasSuffix(domain, "."+baseDomain) {
-					return true
-				}
-			} else {
-				// Otherwise, check if the email domain exactly matches the allowed domain.
-				if strings.EqualFold(domain, a) {
-					return true
-				}
-			}
-		}
+	// "*@domain" is the same as "domain".
+	a = strings.TrimPrefix(a, "*@")
+	// If the allowed entry is an exact match for the whole email address.
+	if local, allowedDomain, ok := strings.Cut(a, "@"); ok {
+		return strings.EqualFold(parts[0], local) && domain == NormalizeDomain(allowedDomain)
+	}
+	// Otherwise the allowed entry is a domain.
+	return matchDomain(domain, a)
+}
+
+// matchDomain returns true if the normalized domain matches the allowed
+// domain or wildcard domain.
+func matchDomain(domain string, a string) bool {
+	// Check for a wildcard domain.
+	if baseDomain, ok := strings.CutPrefix(a, "*."); ok {
+		// Check that the email's domain ends with the base domain preceded by a dot.
+		return strings.HasSuffix(domain, "."+NormalizeDomain(baseDomain))
 	}
-	return false
+	// Otherwise, check if the email domain exactly matches the allowed domain.
+	return domain == NormalizeDomain(a)
 }
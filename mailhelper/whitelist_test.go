@@ -63,6 +63,42 @@ func TestIsWhitelistedEmail(t *testing.T) {
 			allowed: []string{"gmail.com", "yahoo.com"},
 			want:    false,
 		},
+		{
+			name:    "Wildcard domain is case insensitive",
+			email:   "user@Store.Apple.COM",
+			allowed: []string{"*.apple.com"},
+			want:    true,
+		},
+		{
+			name:    "Trailing dot",
+			email:   "user@gmail.com.",
+			allowed: []string{"gmail.com"},
+			want:    true,
+		},
+		{
+			name:    "Internationalized domain matches its punycode",
+			email:   "user@xn--bcher-kva.de",
+			allowed: []string{"bücher.de"},
+			want:    true,
+		},
+		{
+			name:    "Lookalike domain does not match",
+			email:   "user@xn--pypal-4ve.com",
+			allowed: []string{"paypal.com"},
+			want:    false,
+		},
+		{
+			name:    "Any address of the domain",
+			email:   "john@github.com",
+			allowed: []string{"*@github.com"},
+			want:    true,
+		},
+		{
+			name:    "Any address of another domain",
+			email:   "john@evil-github.com",
+			allowed: []string{"*@github.com"},
+			want:    false,
+		},
 	}
 
 	for _, tc := range tests {
@@ -74,3 +110,14 @@ func TestIsWhitelistedEmail(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchWhitelist(t *testing.T) {
+	allowed := []string{"john@example.com", "*.apple.com", "gmail.com"}
+	entry, ok := MatchWhitelist("user@store.apple.com", allowed)
+	if !ok || entry != "*.apple.com" {
+		t.Errorf("MatchWhitelist() = %q, %v, want *.apple.com", entry, ok)
+	}
+	if entry, ok := MatchWhitelist("user@outlook.com", allowed); ok {
+		t.Errorf("MatchWhitelist() = %q, want no match", entry)
+	}
+}
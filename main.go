@@ -1,18 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"llm-antispam/llm"
 	"llm-antispam/mailhelper"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"github.com/emersion/go-imap/client"
+	"github.com/tmc/langchaingo/embeddings"
 	"github.com/tmc/langchaingo/llms"
 )
 
@@ -25,17 +28,131 @@ var (
 )
 
 type Config struct {
-	Rules        []Rule   `yaml:"rules"`
-	Domains      []string `yaml:"whitelisted_domains"`
-	Interval     uint32   `yaml:"interval"`
-	Concurrency  bool     `yaml:"concurrency"`
-	UidFilesPath string   `yaml:"uid_files_path"`
-	LLM          LLM      `yaml:"llm"`
+	Rules         []Rule        `yaml:"rules"`
+	Domains       []string      `yaml:"whitelisted_domains"`
+	Interval      uint32        `yaml:"interval"`
+	Concurrency   bool          `yaml:"concurrency"`
+	UidFilesPath  string        `yaml:"uid_files_path"`
+	LLM           LLM           `yaml:"llm"`
+	Cache         Cache         `yaml:"cache"`
+	Usage         Usage         `yaml:"usage"`
+	Blocklist     Blocklist     `yaml:"blocklist"`
+	AutoWhitelist AutoWhitelist `yaml:"auto_whitelist"`
+	Lookalike     Lookalike     `yaml:"lookalike_detection"`
+	Received      Received      `yaml:"received_analysis"`
+	DNSBL         DNSBL         `yaml:"dnsbl"`
+	Bayes         Bayes         `yaml:"bayes"`
+	KNN           KNN           `yaml:"knn"`
+
+	UpstreamInPrompt bool `yaml:"upstream_in_prompt"`
+	// UpstreamFilters are the upstream filters whose headers are trusted, in
+	// priority order. None is trusted if empty.
+	UpstreamFilters []string       `yaml:"upstream_filters"`
+	AttachmentText  AttachmentText `yaml:"attachment_text"`
+	// HeaderFeatures are the header features added to the prompt.
+	HeaderFeatures []string `yaml:"header_features"`
+	// TrustedAuthServIDs are the authserv-ids of our own mail servers, whose
+	// Authentication-Results headers can be trusted.
+	TrustedAuthServIDs []string `yaml:"trusted_authserv_ids"`
+	// AuthenticatedWhitelist only honours the whitelist for authenticated
+	// senders.
+	AuthenticatedWhitelist bool `yaml:"authenticated_whitelist"`
+	// VerifyDKIM checks the DKIM signatures of every message locally.
+	VerifyDKIM bool `yaml:"verify_dkim"`
+}
+
+// AutoWhitelist configures the whitelisting of the recipients of our sent
+// mail.
+type AutoWhitelist struct {
+	Enabled      bool     `yaml:"enabled"`
+	Mailboxes    []string `yaml:"mailboxes"`
+	Path         string   `yaml:"path"`
+	ExpireMonths int      `yaml:"expire_months"`
+}
+
+// Lookalike configures the detection of sender domains imitating whitelisted
+// and brand domains.
+type Lookalike struct {
+	Enabled bool     `yaml:"enabled"`
+	Brands  []string `yaml:"brands"`
+}
+
+// Received configures the analysis of the Received headers.
+type Received struct {
+	Enabled       bool     `yaml:"enabled"`
+	TrustedRelays []string `yaml:"trusted_relays"`
+}
+
+// DNSBL configures the DNS blocklist lookups of the origin IP and link
+// domains.
+type DNSBL struct {
+	Enabled     bool     `yaml:"enabled"`
+	IPZones     []string `yaml:"ip_zones"`
+	DomainZones []string `yaml:"domain_zones"`
+	// Nameserver is the host:port of the DNS server queried instead of the
+	// system resolver, e.g. a local rbldnsd.
+	Nameserver string `yaml:"nameserver"`
+}
+
+// Bayes configures the local Bayesian pre-filter and its training.
+type Bayes struct {
+	Enabled       bool     `yaml:"enabled"`
+	Path          string   `yaml:"path"`
+	SpamMailboxes []string `yaml:"spam_mailboxes"`
+	HamMailboxes  []string `yaml:"ham_mailboxes"`
+	MinMessages   int      `yaml:"min_messages"`
+	HamBelow      float64  `yaml:"ham_below"`
+	SpamAbove     float64  `yaml:"spam_above"`
+}
+
+// KNN configures the embedding nearest-neighbour classifier and its training.
+type KNN struct {
+	Enabled bool `yaml:"enabled"`
+	// Provider and ModelID are the embedding model, by default the provider of
+	// the LLM.
+	Provider      string   `yaml:"provider"`
+	ModelID       string   `yaml:"model_id"`
+	Path          string   `yaml:"path"`
+	MaxVectors    int      `yaml:"max_vectors"`
+	SpamMailboxes []string `yaml:"spam_mailboxes"`
+	HamMailboxes  []string `yaml:"ham_mailboxes"`
+
+	Policy mailhelper.KNNPolicy `yaml:",inline"`
+}
+
+// Blocklist configures the senders moved to spam without asking the LLM.
+type Blocklist struct {
+	Entries []string `yaml:"entries"`
+	Score   *float64 `yaml:"score"`
+}
+
+// AttachmentText configures the text extraction of document attachments.
+type AttachmentText struct {
+	Enabled   bool  `yaml:"enabled"`
+	MaxSize   int64 `yaml:"max_size"`
+	MaxTokens int   `yaml:"max_tokens"`
+}
+
+// Usage configures the token usage and cost accounting.
+type Usage struct {
+	Enabled     bool                 `yaml:"enabled"`
+	Path        string               `yaml:"path"`
+	DailyBudget float64              `yaml:"daily_budget"`
+	Prices      map[string]llm.Price `yaml:"prices"`
+}
+
+// Cache configures the persistent verdict cache.
+type Cache struct {
+	Enabled    bool   `yaml:"enabled"`
+	Path       string `yaml:"path"`
+	TTL        uint32 `yaml:"ttl"`
+	MaxEntries int    `yaml:"max_entries"`
 }
 
 type LLM struct {
-	Provider string `yaml:"provider"`
-	ModelID  string `yaml:"model_id"`
+	Provider      string `yaml:"provider"`
+	ModelID       string `yaml:"model_id"`
+	MaxBodyTokens int    `yaml:"max_body_tokens"`
 }
 
 // Rule represents each rule in the YAML file.
@@ -44,6 +161,9 @@ type Rule struct {
 	Destination string  `yaml:"destination"`
 	Threshold   float64 `yaml:"threshold"`
 	MoveNotSpam bool    `yaml:"move_not_spam"`
+
+	Scoring    mailhelper.ScoringPolicy `yaml:"scoring"`
+	Conditions []mailhelper.Condition   `yaml:"conditions"`
 }
 
 // NewConfig returns a new decoded Config struct
@@ -108,17 +228,20 @@ func ParseFlags() (string, error) {
 	return configPath, nil
 }
 
-func RunRule(c *client.Client, config Rule, domains []string, llmClassifier llms.Model, concurrency bool, UidFilesPath string) error {
+func RunRule(c *client.Client, config Rule, domains []string, llmClassifier llms.Model, concurrency bool, UidFilesPath string, opts ...mailhelper.Option) error {
 	// Retrieve unread emails from the origin folder.
 	messages, ids, done := FetchUnreadEmails(c, config.Origin)
 
+	opts = append(opts[:len(opts):len(opts)],
+		mailhelper.WithScoringPolicy(config.Scoring), mailhelper.WithConditions(config.Conditions))
+
 	lastProcessed, err := NewLastProcessed(fmt.Sprintf("%slast_processed_%s.json", UidFilesPath, config.Origin))
 	if err != nil {
 		log.Printf("Error reading previous last processed ID: %v", err)
 	}
 
 	spamSeqSet, notSpamSeqSet, lastUid, err := ClassifySpam(
-		messages, ids, domains, config.Threshold, lastProcessed.LastProcessedID, llmClassifier, concurrency)
+		messages, ids, domains, config.Threshold, lastProcessed.LastProcessedID, llmClassifier, concurrency, opts...)
 	if err != nil {
 		return fmt.Errorf("error classifying spam: %v", err)
 	}
@@ -151,6 +274,99 @@ func RunRule(c *client.Client, config Rule, domains []string, llmClassifier llms
 	}
 	return nil
 }
+
+// updateContacts adds the recipients of the new messages of the sent
+// mailboxes to the contact book, forgets the expired ones and saves it.
+func updateContacts(c *client.Client, contacts *mailhelper.ContactBook, mailboxes []string) {
+	for _, mailbox := range mailboxes {
+		added, err := mailhelper.ScanSentMailbox(c, mailbox, contacts)
+		if err != nil {
+			log.Printf("Error scanning sent mailbox: %v", err)
+		}
+		if added > 0 {
+			log.Printf("Added %d contacts from %s to the whitelist", added, mailbox)
+		}
+	}
+	if removed := contacts.Expire(time.Now()); removed > 0 {
+		log.Printf("Removed %d expired contacts from the whitelist", removed)
+	}
+	if err := contacts.Save(); err != nil {
+		log.Printf("Error saving contact book: %v", err)
+	}
+}
+
+// trainBayes trains the Bayes model with the new messages of the spam and ham
+// mailboxes and saves it.
+func trainBayes(c *client.Client, model *mailhelper.BayesModel, cfg Bayes) {
+	for _, mailbox := range cfg.SpamMailboxes {
+		learned, err := mailhelper.TrainBayes(c, mailbox, true, model)
+		if err != nil {
+			log.Printf("Error training with spam mailbox: %v", err)
+		}
+		log.Printf("Learned %d spam messages from %s", learned, mailbox)
+	}
+	for _, mailbox := range cfg.HamMailboxes {
+		learned, err := mailhelper.TrainBayes(c, mailbox, false, model)
+		if err != nil {
+			log.Printf("Error training with ham mailbox: %v", err)
+		}
+		log.Printf("Learned %d ham messages from %s", learned, mailbox)
+	}
+	log.Printf("Bayes model trained with %d spam and %d ham messages", model.SpamMessages, model.HamMessages)
+	if err := model.Save(); err != nil {
+		log.Printf("Error saving Bayes model: %v", err)
+	}
+}
+
+// trainKNN adds the embeddings of the new messages of the spam and ham
+// mailboxes to the vector store and saves it.
+func trainKNN(c *client.Client, embedder embeddings.Embedder, store *mailhelper.VectorStore, cfg KNN) {
+	for _, mailbox := range cfg.SpamMailboxes {
+		learned, err := mailhelper.TrainKNN(c, mailbox, true, embedder, store)
+		if err != nil {
+			log.Printf("Error training with spam mailbox: %v", err)
+		}
+		log.Printf("Embedded %d spam messages from %s", learned, mailbox)
+	}
+	for _, mailbox := range cfg.HamMailboxes {
+		learned, err := mailhelper.TrainKNN(c, mailbox, false, embedder, store)
+		if err != nil {
+			log.Printf("Error training with ham mailbox: %v", err)
+		}
+		log.Printf("Embedded %d ham messages from %s", learned, mailbox)
+	}
+	log.Printf("Vector store holds %d messages", store.Len())
+	if err := store.Save(); err != nil {
+		log.Printf("Error saving vector store: %v", err)
+	}
+}
+
+// newResolver returns a resolver querying nameserver (host:port), or the
+// system resolver if it is empty.
+func newResolver(nameserver string) *net.Resolver {
+	if nameserver == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, nameserver)
+		},
+	}
+}
+
+// logUsageReport logs the token usage and cost totals of the day of t.
+func logUsageReport(ledger *llm.UsageLedger, t time.Time) {
+	for _, totals := range ledger.Report(t) {
+		log.Printf(
+			"Usage %s. Account: %s. Rule: %s. Model: %s. Calls: %d. Prompt tokens: %d. Completion tokens: %d. Cost: $%.4f",
+			t.Format("2006-01-02"), totals.Account, totals.Rule, totals.Model,
+			totals.Calls, totals.PromptTokens, totals.CompletionTokens, totals.Cost,
+		)
+	}
+}
+
 func main() {
 	imapServer, exists := os.LookupEnv("IMAP_SERVER")
 	if !exists {
@@ -176,6 +392,52 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	whitelist, err := mailhelper.NewWhitelistSource(cfg.Domains)
+	if err != nil {
+		log.Fatalf("Invalid whitelisted_domains: %v", err)
+	}
+	blocklist, err := mailhelper.NewListSource(cfg.Blocklist.Entries)
+	if err != nil {
+		log.Fatalf("Invalid blocklist: %v", err)
+	}
+	trustedRelays, err := mailhelper.ParseTrustedRelays(cfg.Received.TrustedRelays)
+	if err != nil {
+		log.Fatalf("Invalid trusted_relays: %v", err)
+	}
+	if err := mailhelper.ValidateHeaderFeatures(cfg.HeaderFeatures); err != nil {
+		log.Fatalf("Invalid header_features: %v", err)
+	}
+	if err := mailhelper.ValidateUpstreamFilters(cfg.UpstreamFilters); err != nil {
+		log.Fatalf("Invalid upstream_filters: %v", err)
+	}
+	if cfg.Bayes.Enabled && (cfg.Bayes.HamBelow < 0 || cfg.Bayes.HamBelow >= cfg.Bayes.SpamAbove || cfg.Bayes.SpamAbove > 1) {
+		log.Fatalf("Invalid bayes: ham_below and spam_above must be probabilities with ham_below < spam_above")
+	}
+	if cfg.KNN.Enabled {
+		if err := cfg.KNN.Policy.Validate(); err != nil {
+			log.Fatalf("Invalid knn: %v", err)
+		}
+		if cfg.KNN.Provider == "" {
+			cfg.KNN.Provider = cfg.LLM.Provider
+		}
+	}
+	command := flag.Arg(0)
+	if command != "" && command != "train" {
+		log.Fatalf("Unknown command %q, the only command is train", command)
+	}
+	if command == "train" && !cfg.Bayes.Enabled && !cfg.KNN.Enabled {
+		log.Fatalf("Nothing to train, enable bayes or knn")
+	}
+	for _, rule := range cfg.Rules {
+		if err := rule.Scoring.Validate(); err != nil {
+			log.Fatalf("Invalid scoring in rule %s: %v", rule.Origin, err)
+		}
+		for _, condition := range rule.Conditions {
+			if err := condition.Validate(); err != nil {
+				log.Fatalf("Invalid condition in rule %s: %v", rule.Origin, err)
+			}
+		}
+	}
 
 	// Create a channel to listen for the SIGTSTP signal.
 	sigChan := make(chan os.Signal, 1)
@@ -204,6 +466,130 @@ func main() {
 
 	log.Println("Connected to IMAP server successfully!")
 
+	var bayes *mailhelper.BayesModel
+	if cfg.Bayes.Enabled {
+		bayes, err = mailhelper.NewBayesModel(cfg.Bayes.Path, cfg.Bayes.MinMessages)
+		if err != nil && command == "train" {
+			// Training would overwrite the unreadable model with the new
+			// messages only.
+			log.Fatalf("Error reading Bayes model: %v", err)
+		} else if err != nil {
+			log.Printf("Error reading Bayes model: %v", err)
+		}
+	}
+	var embedder embeddings.Embedder
+	var vectors *mailhelper.VectorStore
+	if cfg.KNN.Enabled {
+		embedder, err = llm.EmbedderFactory(cfg.KNN.Provider, cfg.KNN.ModelID)
+		if err != nil {
+			log.Fatalf("Error creating embedder: %v", err)
+		}
+		vectors, err = mailhelper.NewVectorStore(cfg.KNN.Path, cfg.KNN.MaxVectors)
+		if err != nil && command == "train" {
+			// Training would overwrite the unreadable store with the new
+			// messages only.
+			log.Fatalf("Error reading vector store: %v", err)
+		} else if err != nil {
+			log.Printf("Error reading vector store: %v", err)
+		}
+	}
+	var ledger *llm.UsageLedger
+	if cfg.Usage.Enabled {
+		ledger, err = llm.NewUsageLedger(cfg.Usage.Path, cfg.Usage.Prices, cfg.Usage.DailyBudget)
+		if err != nil {
+			log.Printf("Error reading usage ledger: %v", err)
+		}
+	}
+	if command == "train" {
+		if bayes != nil {
+			trainBayes(c, bayes, cfg.Bayes)
+		}
+		if vectors != nil {
+			if ledger != nil {
+				embedder = llm.NewMeteredEmbedder(embedder, ledger, imapUser, "train", cfg.KNN.Provider, cfg.KNN.ModelID)
+			}
+			trainKNN(c, embedder, vectors, cfg.KNN)
+		}
+		if ledger != nil {
+			if err := ledger.Save(); err != nil {
+				log.Printf("Error saving usage ledger: %v", err)
+			}
+		}
+		return
+	}
+
+	opts := []mailhelper.Option{mailhelper.WithWhitelist(whitelist)}
+	if cfg.LLM.MaxBodyTokens > 0 {
+		opts = append(opts, mailhelper.WithTokenBudget(cfg.LLM.MaxBodyTokens, func(text string) int {
+			return llm.CountTokens(cfg.LLM.Provider, cfg.LLM.ModelID, text)
+		}))
+	}
+	if cfg.AttachmentText.Enabled {
+		opts = append(opts, mailhelper.WithAttachmentText(cfg.AttachmentText.MaxSize, cfg.AttachmentText.MaxTokens, func(text string) int {
+			return llm.CountTokens(cfg.LLM.Provider, cfg.LLM.ModelID, text)
+		}))
+	}
+	if cfg.UpstreamInPrompt {
+		opts = append(opts, mailhelper.WithUpstreamContext())
+	}
+	if len(cfg.UpstreamFilters) > 0 {
+		opts = append(opts, mailhelper.WithUpstreamFilters(cfg.UpstreamFilters, trustedRelays))
+	}
+	if len(cfg.TrustedAuthServIDs) > 0 {
+		opts = append(opts, mailhelper.WithAuthServIDs(cfg.TrustedAuthServIDs))
+	}
+	if cfg.AuthenticatedWhitelist {
+		opts = append(opts, mailhelper.WithAuthenticatedWhitelist())
+	}
+	if len(cfg.Blocklist.Entries) > 0 {
+		score := 10.0
+		if cfg.Blocklist.Score != nil {
+			score = *cfg.Blocklist.Score
+		}
+		opts = append(opts, mailhelper.WithBlocklist(blocklist, score))
+	}
+	if len(cfg.HeaderFeatures) > 0 {
+		opts = append(opts, mailhelper.WithHeaderFeatures(cfg.HeaderFeatures, trustedRelays))
+	}
+	if cfg.Received.Enabled {
+		opts = append(opts, mailhelper.WithReceivedAnalysis(trustedRelays))
+	}
+	if cfg.Lookalike.Enabled {
+		brands := append(mailhelper.BrandDomains[:len(mailhelper.BrandDomains):len(mailhelper.BrandDomains)], cfg.Lookalike.Brands...)
+		opts = append(opts, mailhelper.WithLookalikeDetection(brands))
+	}
+	if cfg.DNSBL.Enabled {
+		resolver := newResolver(cfg.DNSBL.Nameserver)
+		opts = append(opts, mailhelper.WithDNSBL(mailhelper.NewDNSBLChecker(resolver, cfg.DNSBL.IPZones, cfg.DNSBL.DomainZones), trustedRelays))
+	}
+	if cfg.Bayes.Enabled {
+		opts = append(opts, mailhelper.WithBayesFilter(bayes, cfg.Bayes.HamBelow, cfg.Bayes.SpamAbove))
+	}
+	if cfg.KNN.Enabled {
+		opts = append(opts, mailhelper.WithKNNClassifier(embedder, vectors, cfg.KNN.Policy))
+	}
+	if cfg.VerifyDKIM {
+		opts = append(opts, mailhelper.WithDKIMVerification(net.DefaultResolver))
+	}
+	var contacts *mailhelper.ContactBook
+	if cfg.AutoWhitelist.Enabled {
+		contacts, err = mailhelper.NewContactBook(cfg.AutoWhitelist.Path, cfg.AutoWhitelist.ExpireMonths)
+		if err != nil {
+			log.Printf("Error reading contact book: %v", err)
+		}
+		opts = append(opts, mailhelper.WithContacts(contacts))
+	}
+	var cache *mailhelper.VerdictCache
+	if cfg.Cache.Enabled {
+		cache, err = mailhelper.NewVerdictCache(
+			cfg.Cache.Path, time.Duration(cfg.Cache.TTL)*time.Second, cfg.Cache.MaxEntries)
+		if err != nil {
+			log.Printf("Error reading verdict cache: %v", err)
+		}
+		opts = append(opts, mailhelper.WithCache(cache, cfg.LLM.Provider+"/"+cfg.LLM.ModelID))
+	}
+	reportDay := time.Now()
+
 	// Run the processing loop until SIGTSTP is received.
 	for {
 		select {
@@ -211,16 +597,51 @@ func main() {
 			log.Println("Signal received, shutting down gracefully...")
 			return
 		case <-ticker.C:
+			if ledger != nil {
+				now := time.Now()
+				if now.Format("2006-01-02") != reportDay.Format("2006-01-02") {
+					logUsageReport(ledger, reportDay)
+					reportDay = now
+				}
+				if ledger.BudgetExceeded(now) {
+					// Only the paid calls pause, the free checks keep running
+					// and the other messages are held for tomorrow.
+					log.Printf("Daily budget of $%.2f exceeded, paid providers are paused until tomorrow", cfg.Usage.DailyBudget)
+				}
+			}
 			llmClassifier, err := llm.LLMFactory(cfg.LLM.Provider, cfg.LLM.ModelID)
 			if err != nil {
 				log.Fatalf("Error creating LLM: %v", err)
 			}
+			if contacts != nil {
+				updateContacts(c, contacts, cfg.AutoWhitelist.Mailboxes)
+			}
 			for _, config := range cfg.Rules {
-				err := RunRule(c, config, cfg.Domains, llmClassifier, cfg.Concurrency, cfg.UidFilesPath)
+				ruleOpts := opts
+				if ledger != nil {
+					ruleOpts = append(ruleOpts[:len(ruleOpts):len(ruleOpts)],
+						mailhelper.WithUsageLedger(ledger, imapUser, config.Origin, cfg.LLM.Provider, cfg.LLM.ModelID))
+					if embedder != nil {
+						// Replaces the k-NN classifier above, accounting its embeddings too.
+						metered := llm.NewMeteredEmbedder(embedder, ledger, imapUser, config.Origin, cfg.KNN.Provider, cfg.KNN.ModelID)
+						ruleOpts = append(ruleOpts, mailhelper.WithKNNClassifier(metered, vectors, cfg.KNN.Policy))
+					}
+				}
+				err := RunRule(c, config, cfg.Domains, llmClassifier, cfg.Concurrency, cfg.UidFilesPath, ruleOpts...)
 				if err != nil {
 					log.Println(err)
 				}
 			}
+			if cache != nil {
+				if err := cache.Save(); err != nil {
+					log.Printf("Error saving verdict cache: %v", err)
+				}
+			}
+			if ledger != nil {
+				if err := ledger.Save(); err != nil {
+					log.Printf("Error saving usage ledger: %v", err)
+				}
+			}
 		}
 	}
 }